@@ -0,0 +1,89 @@
+package accounts
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Account is a set of credentials which may connect to the server, along
+// with the entity a connection using them controls.
+type Account struct {
+	ID       uuid.UUID `json:"id"`
+	EntityID uuid.UUID `json:"entityID"`
+
+	// TokenHash is the hex-encoded SHA-256 digest of the account's token.
+	TokenHash string `json:"tokenHash"`
+
+	// Admin accounts may issue commands on behalf of any entity.
+	Admin bool `json:"admin,omitempty"`
+}
+
+// HashToken returns the value to store as an Account's TokenHash for the
+// provided token.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Store is a read-only collection of accounts, keyed by account ID.
+type Store struct {
+	byID map[uuid.UUID]Account
+}
+
+// Authenticate verifies the token presented for the given account ID,
+// returning the ID of the entity the account controls.
+func (s Store) Authenticate(id uuid.UUID, token string) (uuid.UUID, error) {
+	account, ok := s.byID[id]
+	if !ok {
+		return uuid.Nil, errors.New("invalid credentials")
+	}
+
+	given := []byte(HashToken(token))
+	expected := []byte(account.TokenHash)
+	if subtle.ConstantTimeCompare(given, expected) != 1 {
+		return uuid.Nil, errors.New("invalid credentials")
+	}
+
+	return account.EntityID, nil
+}
+
+// CanControl reports whether the account may issue commands on behalf of
+// the entity: its own entity, or any entity for admin accounts.
+func (s Store) CanControl(id uuid.UUID, entityID uuid.UUID) bool {
+	account, ok := s.byID[id]
+	if !ok {
+		return false
+	}
+
+	return account.Admin || uuid.Equal(account.EntityID, entityID)
+}
+
+// FromJSONFile loads a Store from a JSON list of accounts.
+func FromJSONFile(path string) (Store, error) {
+	store := Store{byID: make(map[uuid.UUID]Account)}
+
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return store, errors.Wrapf(err, "could not find json file %s", path)
+	}
+
+	allAccounts := make([]Account, 0)
+	if err = json.Unmarshal(bytes, &allAccounts); err != nil {
+		return store, errors.Wrapf(err, "not a valid json file %s", path)
+	}
+
+	for _, account := range allAccounts {
+		if _, ok := store.byID[account.ID]; ok {
+			return store, errors.Errorf("duplicate account %s in %s", account.ID, path)
+		}
+		store.byID[account.ID] = account
+	}
+
+	return store, nil
+}
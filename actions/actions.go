@@ -2,6 +2,10 @@ package actions
 
 import (
 	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
 
 	"github.com/clagraff/devoid/components"
 	"github.com/clagraff/devoid/entities"
@@ -11,43 +15,123 @@ import (
 )
 
 type Action interface {
-	Execute(*entities.Locker)
+	Execute(entities.Store) error
 }
 
+// Factory returns a pointer to a new, zero-valued Action.
+type Factory func() Action
+
+// actionType is the Action interface type.
+var actionType = reflect.TypeOf((*Action)(nil)).Elem()
+
+// registry maps wire kinds to action factories, and action types back to
+// their wire kinds.
+var registry = struct {
+	mux    sync.RWMutex
+	byKind map[string]Factory
+	byType map[reflect.Type]string
+}{
+	byKind: make(map[string]Factory),
+	byType: make(map[reflect.Type]string),
+}
+
+// Register makes an action available to Unmarshal and KindOf under the
+// provided wire kind. The factory must return a pointer to a new,
+// zero-valued action, whose type implements Action itself rather than
+// only through the pointer; Unmarshal returns the pointed-to value. Register
+// panics if the kind or the action type is already registered, or if the
+// type does not implement Action.
+func Register(kind string, factory Factory) {
+	registry.mux.Lock()
+	defer registry.mux.Unlock()
+
+	prototype := reflect.TypeOf(factory())
+	if prototype.Kind() != reflect.Ptr {
+		panic(errs.Errorf("factory for action kind %s must return a pointer", kind))
+	}
+
+	if !prototype.Elem().Implements(actionType) {
+		panic(errs.Errorf(
+			"%s does not implement Action; action kind %s needs value receivers",
+			prototype.Elem(),
+			kind,
+		))
+	}
+
+	if _, ok := registry.byKind[kind]; ok {
+		panic(errs.Errorf("action kind %s is already registered", kind))
+	}
+
+	if other, ok := registry.byType[prototype.Elem()]; ok {
+		panic(errs.Errorf("%s is already registered as %s", prototype.Elem(), other))
+	}
+
+	registry.byKind[kind] = factory
+	registry.byType[prototype.Elem()] = kind
+}
+
+// KindOf returns the wire kind the action's type is registered under.
+func KindOf(action Action) (string, error) {
+	registry.mux.RLock()
+	defer registry.mux.RUnlock()
+
+	kind, ok := registry.byType[reflect.TypeOf(action)]
+	if !ok {
+		return "", errs.Errorf("unregistered action type: %T", action)
+	}
+
+	return kind, nil
+}
+
+// Kinds returns every registered wire kind, in sorted order.
+func Kinds() []string {
+	registry.mux.RLock()
+	defer registry.mux.RUnlock()
+
+	kinds := make([]string, 0, len(registry.byKind))
+	for kind := range registry.byKind {
+		kinds = append(kinds, kind)
+	}
+
+	sort.Strings(kinds)
+	return kinds
+}
+
+// Unmarshal decodes JSON into a new action of the provided wire kind.
 func Unmarshal(kind string, bytes []byte) (Action, error) {
-	var err error
-	var action Action
-
-	switch kind {
-	case "actions.MoveTo":
-		moveToAction := MoveTo{}
-		err = json.Unmarshal(bytes, &moveToAction)
-		action = moveToAction
-	case "actions.MoveFrom":
-		moveFromAction := MoveFrom{}
-		err = json.Unmarshal(bytes, &moveFromAction)
-		action = moveFromAction
-	case "actions.SetEntity":
-		setEntityAction := SetEntity{}
-		err = json.Unmarshal(bytes, &setEntityAction)
-		action = setEntityAction
-	case "actions.ClearAllEntities":
-		mut := ClearAllEntities{}
-		err = json.Unmarshal(bytes, &mut)
-		action = mut
-	case "actions.SetStackability":
-		mut := SetStackability{}
-		err = json.Unmarshal(bytes, &mut)
-		action = mut
-	default:
+	return Decode(kind, func(ptr interface{}) error {
+		return json.Unmarshal(bytes, ptr)
+	})
+}
+
+// Decode creates a new action of the provided wire kind, filled in by
+// decode from a pointer to it.
+func Decode(kind string, decode func(ptr interface{}) error) (Action, error) {
+	registry.mux.RLock()
+	factory, ok := registry.byKind[kind]
+	registry.mux.RUnlock()
+
+	if !ok {
 		return nil, errs.Errorf("invalid action kind: %s", kind)
 	}
 
-	if err == nil {
-		return action, err
+	ptr := factory()
+	if err := decode(ptr); err != nil {
+		return nil, errs.New(err)
 	}
 
-	return nil, errs.New(err)
+	return reflect.ValueOf(ptr).Elem().Interface().(Action), nil
+}
+
+func init() {
+	Register("move-to", func() Action { return new(MoveTo) })
+	Register("move-from", func() Action { return new(MoveFrom) })
+	Register("set-entity", func() Action { return new(SetEntity) })
+	Register("set-stackability", func() Action { return new(SetStackability) })
+	Register("clear-all-entities", func() Action { return new(ClearAllEntities) })
+	Register("remove-entity", func() Action { return new(RemoveEntity) })
+	Register("command-rejected", func() Action { return new(CommandRejected) })
+	Register("disconnect", func() Action { return new(Disconnect) })
 }
 
 type MoveTo struct {
@@ -55,16 +139,16 @@ type MoveTo struct {
 	Position components.Position
 }
 
-func (moveTo MoveTo) Execute(locker *entities.Locker) {
-	entity, err := locker.GetByID(moveTo.SourceID)
+func (moveTo MoveTo) Execute(locker entities.Store) error {
+	err := locker.Update(moveTo.SourceID, func(entity *entities.Entity) error {
+		entity.Attach(moveTo.Position)
+		return nil
+	})
 	if err != nil {
-		panic(err)
+		return errs.New(err)
 	}
 
-	entity.Position.X = moveTo.Position.X
-	entity.Position.Y = moveTo.Position.Y
-
-	locker.Set(entity)
+	return nil
 }
 
 type MoveFrom struct {
@@ -72,16 +156,24 @@ type MoveFrom struct {
 	Position components.Position
 }
 
-func (moveFrom MoveFrom) Execute(locker *entities.Locker) {
-	locker.DeleteFromPos(moveFrom.SourceID, moveFrom.Position)
+func (moveFrom MoveFrom) Execute(locker entities.Store) error {
+	if err := locker.DeleteFromPos(moveFrom.SourceID, moveFrom.Position); err != nil {
+		return errs.New(err)
+	}
+
+	return nil
 }
 
 type SetEntity struct {
 	Entity entities.Entity
 }
 
-func (setEntity SetEntity) Execute(locker *entities.Locker) {
-	locker.Set(setEntity.Entity)
+func (setEntity SetEntity) Execute(locker entities.Store) error {
+	if err := locker.Set(setEntity.Entity); err != nil {
+		return errs.New(err)
+	}
+
+	return nil
 }
 
 type SetStackability struct {
@@ -89,14 +181,92 @@ type SetStackability struct {
 	Stackability bool
 }
 
-func (m SetStackability) Execute(locker *entities.Locker) {
-	entity := m.Entity
-	entity.Spatial.Stackable = m.Stackability
-	locker.Set(entity)
+// Execute applies the stackability change to the entity snapshot. If the
+// entity has been modified since the snapshot was taken, the change is
+// rebased onto the current version instead of overwriting it.
+func (m SetStackability) Execute(locker entities.Store) error {
+	entity := m.apply(m.Entity)
+
+	err := locker.CompareAndSet(entity)
+	if err == nil {
+		return nil
+	}
+	if !entities.IsVersionConflict(err) {
+		return errs.New(err)
+	}
+
+	entity, err = locker.GetByID(m.Entity.ID)
+	if err != nil {
+		return errs.New(err)
+	}
+
+	entity = m.apply(entity)
+	if err = locker.CompareAndSet(entity); err != nil {
+		return errs.New(err)
+	}
+
+	return nil
+}
+
+func (m SetStackability) apply(entity entities.Entity) entities.Entity {
+	spatial, _ := entity.Spatial()
+	spatial.Stackable = m.Stackability
+	entity.Attach(spatial)
+	return entity
+}
+
+// RemoveEntity deletes a single entity. Removing an entity the locker does
+// not hold is not an error.
+type RemoveEntity struct {
+	ID uuid.UUID
+}
+
+func (remove RemoveEntity) Execute(locker entities.Store) error {
+	if _, err := locker.GetByID(remove.ID); err != nil {
+		return nil
+	}
+
+	if err := locker.Delete(remove.ID); err != nil {
+		return errs.New(err)
+	}
+
+	return nil
 }
 
 type ClearAllEntities struct{}
 
-func (_ ClearAllEntities) Execute(locker *entities.Locker) {
+func (_ ClearAllEntities) Execute(locker entities.Store) error {
 	locker.DeleteAll()
+	return nil
+}
+
+// CommandRejected informs a client that one of its commands could not be
+// computed by the server. It does not modify the locker.
+type CommandRejected struct {
+	Reason   string
+	Command  string
+	SourceID uuid.UUID
+	Message  string
+}
+
+func (_ CommandRejected) Execute(locker entities.Store) error {
+	return nil
+}
+
+func (rejected CommandRejected) String() string {
+	return fmt.Sprintf("%s rejected: %s", rejected.Command, rejected.Message)
+}
+
+// Disconnect informs a client that the server is closing its connection.
+// It does not modify the locker.
+type Disconnect struct {
+	Reason string
+}
+
+func (_ Disconnect) Execute(locker entities.Store) error {
+	return nil
+}
+
+func (disconnect Disconnect) String() string {
+	return "disconnected: " + disconnect.Reason
 }
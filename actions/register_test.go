@@ -0,0 +1,29 @@
+package actions_test
+
+import (
+	"testing"
+
+	"github.com/clagraff/devoid/actions"
+	"github.com/clagraff/devoid/entities"
+)
+
+// echo only implements Action through its pointer.
+type echo struct{}
+
+func (e *echo) Execute(entities.Store) error {
+	return nil
+}
+
+func TestRegisterRejectsPointerReceivers(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering a pointer-receiver action to panic")
+		}
+
+		if _, err := actions.Decode("echo", func(interface{}) error { return nil }); err == nil {
+			t.Error("an action which failed to register can still be decoded")
+		}
+	}()
+
+	actions.Register("echo", func() actions.Action { return new(echo) })
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/clagraff/devoid/entities"
 	"github.com/clagraff/devoid/network"
 
+	errs "github.com/go-errors/errors"
 	termbox "github.com/nsf/termbox-go"
 	uuid "github.com/satori/go.uuid"
 )
@@ -51,14 +52,19 @@ const (
 	left
 )
 
-func Serve(entityID uuid.UUID, locker *entities.Locker, tunnel network.Tunnel, commandsQueue chan commands.Command) {
+// Serve runs the client's interface until the user quits, returning nil, or
+// until the server disconnects the client or the connection is lost,
+// returning why.
+func Serve(entityID uuid.UUID, locker *entities.Locker, tunnel network.Tunnel, commandsQueue chan commands.Command) error {
 	messagesQueue := make(chan network.Message, 100)
 	actionsQueue := make(chan actions.Action, 100)
+	statusQueue := make(chan string, 100)
 	uiEvents := make(chan termbox.Event, 100)
+	disconnected := make(chan error, 1)
 
-	go handleActions(locker, actionsQueue)
-	go handleTunnel(locker, tunnel, messagesQueue, actionsQueue)
-	go handleCommands(tunnel.ID, commandsQueue, messagesQueue)
+	go handleActions(locker, actionsQueue, statusQueue)
+	go handleTunnel(locker, tunnel, messagesQueue, actionsQueue, statusQueue, disconnected)
+	go handleCommands(tunnel, commandsQueue, messagesQueue)
 
 	go pollTerminalEvents(uiEvents)
 
@@ -72,14 +78,20 @@ func Serve(entityID uuid.UUID, locker *entities.Locker, tunnel network.Tunnel, c
 	ticker := time.NewTicker(33 * time.Millisecond)
 	defer ticker.Stop()
 
+	status := ""
+
 	for {
 		select {
+		case status = <-statusQueue:
+		case err := <-disconnected:
+			close(actionsQueue)
+			return err
 		case ev := <-uiEvents:
 			if ev.Ch == 'q' {
 				close(messagesQueue)
 				close(actionsQueue)
 				close(uiEvents)
-				return
+				return nil
 			} else if ev.Key == termbox.KeyArrowUp {
 				moveTo(locker, entityID, up, commandsQueue)
 			} else if ev.Key == termbox.KeyArrowDown {
@@ -96,79 +108,168 @@ func Serve(entityID uuid.UUID, locker *entities.Locker, tunnel network.Tunnel, c
 				panic(err)
 			}
 
-			allEntities := locker.All()
-			for _, entity := range allEntities {
-				char := '@'
-				if entity.Spatial.Toggleable {
+			// Spawn points are drawn as floor, and the player is drawn last
+			// so that nothing it stands on hides it.
+			positioned := locker.Query(components.Position{})
+			for _, entity := range positioned {
+				if uuid.Equal(entityID, entity.ID) || entity.Has(components.Spawn{}) {
+					continue
+				}
+
+				pos, _ := entity.Position()
+				spatial, _ := entity.Spatial()
+
+				char := '#'
+				if spatial.Toggleable {
 					char = '+'
-					if entity.Spatial.Stackable {
+					if spatial.Stackable {
 						char = '-'
 					}
-				} else if !uuid.Equal(entityID, entity.ID) {
-					char = '#'
 				}
 
 				termbox.SetCell(
-					entity.Position.X,
-					entity.Position.Y,
+					pos.X,
+					pos.Y,
 					char,
 					termbox.ColorWhite,
 					termbox.ColorBlack,
 				)
 			}
 
+			if player, err := locker.GetByID(entityID); err == nil {
+				if pos, ok := player.Position(); ok {
+					termbox.SetCell(
+						pos.X,
+						pos.Y,
+						'@',
+						termbox.ColorWhite,
+						termbox.ColorBlack,
+					)
+				}
+			}
+
+			_, height := termbox.Size()
+			renderText(0, height-1, status)
+
 			c.Render()
 			termbox.Flush()
-		default:
 		}
 	}
 }
 
+func renderText(x, y int, text string) {
+	for _, ch := range text {
+		termbox.SetCell(x, y, ch, termbox.ColorRed, termbox.ColorBlack)
+		x++
+	}
+}
+
 func pollTerminalEvents(queue chan termbox.Event) {
 	for {
 		queue <- termbox.PollEvent()
 	}
 }
 
-func handleActions(locker *entities.Locker, queue chan actions.Action) {
+func handleActions(locker *entities.Locker, queue chan actions.Action, statusQueue chan string) {
+	failures := 0
+
 	for action := range queue {
-		action.Execute(locker)
+		// Movement anywhere in the surrounding chunks is heard about, but
+		// entities which have not been perceived yet cannot be moved.
+		if moveTo, ok := action.(actions.MoveTo); ok {
+			if _, err := locker.GetByID(moveTo.SourceID); err != nil {
+				continue
+			}
+		}
+
+		if err := action.Execute(locker); err != nil {
+			failures++
+			statusQueue <- fmt.Sprintf("%d failed actions, last: %v", failures, err)
+		}
 	}
 }
 
+// handleTunnel passes messages between the tunnel and the client's queues
+// until the server sends a Disconnect or the connection ends, then sends
+// the reason to disconnected.
 func handleTunnel(
 	locker *entities.Locker,
 	tunnel network.Tunnel,
 	messagesQueue chan network.Message,
 	actionsQueue chan actions.Action,
+	statusQueue chan string,
+	disconnected chan error,
 ) {
 	for {
 		select {
 		case message := <-messagesQueue:
 			tunnel.Outgoing <- message
 		case message := <-tunnel.Incoming:
-			action, err := actions.Unmarshal(message.ContentType, message.Content)
-			if err != nil {
-				panic(err)
+			if err := handleMessage(message, actionsQueue, statusQueue); err != nil {
+				disconnected <- err
+				return
+			}
+		case <-tunnel.Closed:
+			// Everything received before the connection ended, such as the
+			// server's Disconnect, is already waiting on Incoming.
+			for {
+				select {
+				case message := <-tunnel.Incoming:
+					if err := handleMessage(message, actionsQueue, statusQueue); err != nil {
+						disconnected <- err
+						return
+					}
+				default:
+					disconnected <- errs.New("lost connection to the server")
+					return
+				}
 			}
-
-			actionsQueue <- action
-		default:
-			// no-op
 		}
 	}
 }
 
+// handleMessage decodes an action from the server, showing rejections as
+// the status and queueing everything else to be executed. A Disconnect is
+// returned as an error.
+func handleMessage(
+	message network.Message,
+	actionsQueue chan actions.Action,
+	statusQueue chan string,
+) error {
+	action, err := actions.Decode(message.ContentType, message.Decode)
+	if err != nil {
+		panic(err)
+	}
+
+	switch notice := action.(type) {
+	case actions.CommandRejected:
+		statusQueue <- notice.String()
+		return nil
+	case actions.Disconnect:
+		return errs.New(notice.String())
+	}
+
+	actionsQueue <- action
+	return nil
+}
+
 func handleCommands(
-	serverID uuid.UUID,
+	tunnel network.Tunnel,
 	queue chan commands.Command,
 	messagesQueue chan network.Message,
 ) {
 	for command := range queue {
-		messagesQueue <- network.MakeMessage(
-			serverID,
-			command,
-		)
+		kind, err := commands.KindOf(command)
+		if err != nil {
+			panic(err)
+		}
+
+		message, err := tunnel.MakeMessage(kind, command)
+		if err != nil {
+			panic(err)
+		}
+
+		messagesQueue <- message
 	}
 }
 
@@ -179,8 +280,13 @@ func moveTo(locker *entities.Locker, sourceID uuid.UUID, dir direction, queue ch
 		os.Exit(1)
 	}
 
-	x := sourceEntity.Position.X
-	y := sourceEntity.Position.Y
+	sourcePosition, ok := sourceEntity.Position()
+	if !ok {
+		return
+	}
+
+	x := sourcePosition.X
+	y := sourcePosition.Y
 
 	switch dir {
 	case up:
@@ -210,9 +316,9 @@ func moveTo(locker *entities.Locker, sourceID uuid.UUID, dir direction, queue ch
 		isPassable := true
 
 		for _, targetEntity := range entitiesAtPosition {
-			if !targetEntity.Spatial.Stackable {
+			if targetEntity.Blocks() {
 				isPassable = false
-				if !targetEntity.Spatial.Toggleable {
+				if spatial, _ := targetEntity.Spatial(); !spatial.Toggleable {
 					return
 				}
 
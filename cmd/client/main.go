@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"os"
 
+	"github.com/clagraff/devoid/actions"
 	"github.com/clagraff/devoid/client"
 	"github.com/clagraff/devoid/commands"
 	"github.com/clagraff/devoid/entities"
@@ -18,7 +19,7 @@ import (
 type clientConfig struct {
 	CertPath string `json:"certPath"`
 	ClientID uuid.UUID
-	EntityID uuid.UUID
+	Token    string `json:"token"`
 }
 
 func loadClientConfig(path string) clientConfig {
@@ -39,9 +40,22 @@ func loadClientConfig(path string) clientConfig {
 
 func run(cfg clientConfig) {
 	info := network.MakeConnInfo("localhost", 8080, cfg.ClientID, cfg.CertPath, "")
-	c := network.NewClient(info)
+	caps := network.Capabilities{
+		Sends:    commands.Kinds(),
+		Receives: actions.Kinds(),
+	}
+
+	c := network.NewClient(info, cfg.Token, caps)
 	closeFn, tunnel, err := c.Dial()
 	if err != nil {
+		switch refused := err.(type) {
+		case network.RejectedError:
+			fmt.Println(refused.Error())
+			os.Exit(1)
+		case network.IncompatibleError:
+			fmt.Println(refused.Error())
+			os.Exit(1)
+		}
 		if e, ok := err.(*errs.Error); ok {
 			fmt.Println(e.ErrorStack())
 			return
@@ -53,7 +67,9 @@ func run(cfg clientConfig) {
 	locker := entities.MakeLocker()
 	commandsQueue := make(chan commands.Command, 100)
 
-	client.Serve(cfg.EntityID, &locker, tunnel, commandsQueue)
+	if err := client.Serve(tunnel.EntityID, &locker, tunnel, commandsQueue); err != nil {
+		fmt.Println(err)
+	}
 }
 
 func main() {
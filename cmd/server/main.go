@@ -1,21 +1,48 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/clagraff/devoid/accounts"
+	"github.com/clagraff/devoid/actions"
+	"github.com/clagraff/devoid/commands"
 	"github.com/clagraff/devoid/entities"
 	"github.com/clagraff/devoid/network"
 	"github.com/clagraff/devoid/server"
+	"github.com/pkg/errors"
 )
 
 type serverConfig struct {
 	CertPath string `json:"certPath"`
 	KeyPath  string `json:"keyPath"`
 
+	AccountsPath string `json:"accountsPath"`
 	EntitiesPath string `json:"entitiesPath"`
+	PrefabsPath  string `json:"prefabsPath"`
+
+	// MapPath and LegendPath describe an ASCII map used to build the world
+	// when EntitiesPath does not exist yet. LegendPath is optional.
+	MapPath    string `json:"mapPath"`
+	LegendPath string `json:"legendPath"`
+
+	// AutosaveInterval is a duration string such as "5m"; world state is
+	// written back to EntitiesPath on this interval. Empty disables it.
+	AutosaveInterval string `json:"autosaveInterval"`
+
+	// TickRate is the number of world ticks per second.
+	TickRate int `json:"tickRate"`
+
+	// HeartbeatInterval is a duration string such as "5s"; connections are
+	// pinged on this interval and dropped after three silent intervals.
+	// Empty uses network.DefaultHeartbeat.
+	HeartbeatInterval string `json:"heartbeatInterval"`
 }
 
 func loadServerConfig(path string) serverConfig {
@@ -34,26 +61,114 @@ func loadServerConfig(path string) serverConfig {
 	return cfg
 }
 
-func run(cfg serverConfig) {
+func autosave(ctx context.Context, locker *entities.Locker, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := locker.ToJSONFile(path); err != nil {
+				fmt.Printf("autosave failed: %+v\n", err)
+			}
+		}
+	}
+}
+
+func cancelOnSignal(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signals
+	fmt.Println("received", sig, "shutting down")
+	cancel()
+}
+
+// loadWorld reads the entities file, or builds the world from the map file
+// if there is no entities file yet.
+func loadWorld(cfg serverConfig, prefabs entities.Prefabs) (entities.Locker, error) {
 	locker := entities.MakeLocker()
-	if err := locker.FromJSONFile(cfg.EntitiesPath); err != nil {
-		fmt.Printf("%+v\n", err)
-		os.Exit(1)
+
+	_, err := os.Stat(cfg.EntitiesPath)
+	if cfg.MapPath == "" || !os.IsNotExist(err) {
+		return locker, locker.FromJSONFile(cfg.EntitiesPath, prefabs)
+	}
+
+	legend := entities.DefaultLegend()
+	if cfg.LegendPath != "" {
+		legend, err = entities.LoadLegend(cfg.LegendPath)
+		if err != nil {
+			return locker, err
+		}
+	}
+
+	return locker, locker.FromMapFile(cfg.MapPath, legend, prefabs)
+}
+
+func run(cfg serverConfig) error {
+	var prefabs entities.Prefabs
+	if cfg.PrefabsPath != "" {
+		loaded, err := entities.LoadPrefabs(cfg.PrefabsPath)
+		if err != nil {
+			return err
+		}
+		prefabs = loaded
+	}
+
+	locker, err := loadWorld(cfg, prefabs)
+	if err != nil {
+		return err
+	}
+
+	accountStore, err := accounts.FromJSONFile(cfg.AccountsPath)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go cancelOnSignal(cancel)
+
+	if cfg.AutosaveInterval != "" {
+		interval, err := time.ParseDuration(cfg.AutosaveInterval)
+		if err != nil {
+			return errors.Wrap(err, "invalid autosaveInterval")
+		}
+		go autosave(ctx, &locker, cfg.EntitiesPath, interval)
 	}
 
 	info := network.MakeConnInfo("localhost", 8080, network.MakeUUID(),
 		cfg.CertPath, cfg.KeyPath)
 
-	s := network.NewServer(info)
-	closeFn, tunnels, err := s.Serve()
+	caps := network.Capabilities{
+		Sends:    actions.Kinds(),
+		Receives: commands.Kinds(),
+	}
+
+	var heartbeat time.Duration
+	if cfg.HeartbeatInterval != "" {
+		heartbeat, err = time.ParseDuration(cfg.HeartbeatInterval)
+		if err != nil {
+			return errors.Wrap(err, "invalid heartbeatInterval")
+		}
+	}
+
+	s := network.NewServer(info, accountStore, caps, heartbeat)
+	closeFn, tunnels, err := s.Serve(ctx)
 	if err != nil {
-		fmt.Printf("%+v\n", err)
-		os.Exit(1)
+		return err
 	}
 
-	defer closeFn()
+	server.Serve(ctx, server.Config{TickRate: cfg.TickRate}, &locker, accountStore, tunnels)
+
+	if err := closeFn(); err != nil {
+		fmt.Printf("%+v\n", err)
+	}
 
-	server.Serve(&locker, tunnels)
+	return locker.ToJSONFile(cfg.EntitiesPath)
 }
 
 func main() {
@@ -62,5 +177,8 @@ func main() {
 	}
 
 	cfg := loadServerConfig(os.Args[1])
-	run(cfg)
+	if err := run(cfg); err != nil {
+		fmt.Printf("%+v\n", err)
+		os.Exit(1)
+	}
 }
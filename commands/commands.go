@@ -4,11 +4,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"math"
-	"os"
+	"reflect"
+	"sort"
+	"sync"
 
 	"github.com/clagraff/devoid/actions"
 	"github.com/clagraff/devoid/components"
 	"github.com/clagraff/devoid/entities"
+	"github.com/clagraff/devoid/fov"
 	"github.com/clagraff/devoid/pubsub"
 
 	errs "github.com/go-errors/errors"
@@ -16,43 +19,184 @@ import (
 )
 
 type Command interface {
-	Compute(*entities.Locker) ([]actions.Action, []pubsub.Notification)
+	Compute(*entities.Locker) ([]actions.Action, []pubsub.Notification, *Rejection)
+
+	// Source returns the ID of the entity the command is issued on behalf of.
+	Source() uuid.UUID
+}
+
+// Movement is implemented by commands which relocate their source entity.
+// The server applies at most one movement per entity per tick.
+type Movement interface {
+	Command
+	Movement()
+}
+
+// Reason is a short, stable code describing why a command was rejected.
+type Reason string
+
+const (
+	ReasonMalformed     Reason = "malformed"
+	ReasonUnknownEntity Reason = "unknown-entity"
+	ReasonTooFar        Reason = "too-far"
+	ReasonBlocked       Reason = "blocked"
+	ReasonAlreadyThere  Reason = "already-there"
+	ReasonSelfTarget    Reason = "self-target"
+	ReasonThrottled     Reason = "throttled"
+	ReasonFailed        Reason = "failed"
+	ReasonNoComponent   Reason = "missing-component"
+	ReasonForbidden     Reason = "forbidden"
+)
+
+// Rejection describes a command which could not be computed, and is routed
+// back to the client which issued it instead of stopping the server.
+type Rejection struct {
+	Reason   Reason
+	Command  Command
+	SourceID uuid.UUID
+	Message  string
+}
+
+func (r Rejection) Error() string {
+	return fmt.Sprintf("%T rejected (%s): %s", r.Command, r.Reason, r.Message)
+}
+
+// Action returns the client-facing representation of the rejection.
+func (r Rejection) Action() actions.CommandRejected {
+	kind, err := KindOf(r.Command)
+	if err != nil {
+		kind = fmt.Sprintf("%T", r.Command)
+	}
+
+	return actions.CommandRejected{
+		Reason:   string(r.Reason),
+		Command:  kind,
+		SourceID: r.SourceID,
+		Message:  r.Message,
+	}
+}
+
+// Reject builds a Rejection of command for the provided reason.
+func Reject(command Command, reason Reason, format string, args ...interface{}) *Rejection {
+	return &Rejection{
+		Reason:   reason,
+		Command:  command,
+		SourceID: command.Source(),
+		Message:  fmt.Sprintf(format, args...),
+	}
+}
+
+// Factory returns a pointer to a new, zero-valued Command.
+type Factory func() Command
+
+// commandType is the Command interface type.
+var commandType = reflect.TypeOf((*Command)(nil)).Elem()
+
+// registry maps wire kinds to command factories, and command types back to
+// their wire kinds.
+var registry = struct {
+	mux    sync.RWMutex
+	byKind map[string]Factory
+	byType map[reflect.Type]string
+}{
+	byKind: make(map[string]Factory),
+	byType: make(map[reflect.Type]string),
 }
 
+// Register makes a command available to Unmarshal and KindOf under the
+// provided wire kind. The factory must return a pointer to a new,
+// zero-valued command, whose type implements Command itself rather than
+// only through the pointer; Unmarshal returns the pointed-to value. Register
+// panics if the kind or the command type is already registered, or if the
+// type does not implement Command.
+func Register(kind string, factory Factory) {
+	registry.mux.Lock()
+	defer registry.mux.Unlock()
+
+	prototype := reflect.TypeOf(factory())
+	if prototype.Kind() != reflect.Ptr {
+		panic(errs.Errorf("factory for command kind %s must return a pointer", kind))
+	}
+
+	if !prototype.Elem().Implements(commandType) {
+		panic(errs.Errorf(
+			"%s does not implement Command; command kind %s needs value receivers",
+			prototype.Elem(),
+			kind,
+		))
+	}
+
+	if _, ok := registry.byKind[kind]; ok {
+		panic(errs.Errorf("command kind %s is already registered", kind))
+	}
+
+	if other, ok := registry.byType[prototype.Elem()]; ok {
+		panic(errs.Errorf("%s is already registered as %s", prototype.Elem(), other))
+	}
+
+	registry.byKind[kind] = factory
+	registry.byType[prototype.Elem()] = kind
+}
+
+// KindOf returns the wire kind the command's type is registered under.
+func KindOf(command Command) (string, error) {
+	registry.mux.RLock()
+	defer registry.mux.RUnlock()
+
+	kind, ok := registry.byType[reflect.TypeOf(command)]
+	if !ok {
+		return "", errs.Errorf("unregistered command type: %T", command)
+	}
+
+	return kind, nil
+}
+
+// Kinds returns every registered wire kind, in sorted order.
+func Kinds() []string {
+	registry.mux.RLock()
+	defer registry.mux.RUnlock()
+
+	kinds := make([]string, 0, len(registry.byKind))
+	for kind := range registry.byKind {
+		kinds = append(kinds, kind)
+	}
+
+	sort.Strings(kinds)
+	return kinds
+}
+
+// Unmarshal decodes JSON into a new command of the provided wire kind.
 func Unmarshal(kind string, bytes []byte) (Command, error) {
-	var err error
-	var command Command
-
-	switch kind {
-	case "commands.Move":
-		moveCommand := Move{}
-		err = json.Unmarshal(bytes, &moveCommand)
-		command = moveCommand
-	case "commands.Info":
-		infoCommand := Info{}
-		err = json.Unmarshal(bytes, &infoCommand)
-		command = infoCommand
-	case "commands.Perceive":
-		perceiveCommand := Perceive{}
-		err = json.Unmarshal(bytes, &perceiveCommand)
-		command = perceiveCommand
-	case "commands.OpenSpatial":
-		openSpatialCommand := OpenSpatial{}
-		err = json.Unmarshal(bytes, &openSpatialCommand)
-		command = openSpatialCommand
-	case "commands.CloseSpatial":
-		closeSpatialCommand := CloseSpatial{}
-		err = json.Unmarshal(bytes, &closeSpatialCommand)
-		command = closeSpatialCommand
-	default:
+	return Decode(kind, func(ptr interface{}) error {
+		return json.Unmarshal(bytes, ptr)
+	})
+}
+
+// Decode creates a new command of the provided wire kind, filled in by
+// decode from a pointer to it.
+func Decode(kind string, decode func(ptr interface{}) error) (Command, error) {
+	registry.mux.RLock()
+	factory, ok := registry.byKind[kind]
+	registry.mux.RUnlock()
+
+	if !ok {
 		return nil, errs.New("invalid command kind: " + kind)
 	}
 
-	if err == nil {
-		return command, err
+	ptr := factory()
+	if err := decode(ptr); err != nil {
+		return nil, errs.New(err)
 	}
 
-	return nil, errs.New(err)
+	return reflect.ValueOf(ptr).Elem().Interface().(Command), nil
+}
+
+func init() {
+	Register("move", func() Command { return new(Move) })
+	Register("info", func() Command { return new(Info) })
+	Register("perceive", func() Command { return new(Perceive) })
+	Register("open-spatial", func() Command { return new(OpenSpatial) })
+	Register("close-spatial", func() Command { return new(CloseSpatial) })
 }
 
 type Move struct {
@@ -60,27 +204,38 @@ type Move struct {
 	Position components.Position
 }
 
-func (move Move) Compute(locker *entities.Locker) ([]actions.Action, []pubsub.Notification) {
+func (move Move) Source() uuid.UUID {
+	return move.SourceID
+}
+
+func (move Move) Movement() {}
+
+func (move Move) Compute(locker *entities.Locker) ([]actions.Action, []pubsub.Notification, *Rejection) {
 	sourceEntity, err := locker.GetByID(move.SourceID)
 	if err != nil {
-		panic("could not locate entity")
+		return nil, nil, Reject(move, ReasonUnknownEntity, "could not locate entity %s", move.SourceID)
 	}
 
-	xDiff := float64(sourceEntity.Position.X - move.Position.X)
-	yDiff := float64(sourceEntity.Position.Y - move.Position.Y)
+	sourcePosition, ok := sourceEntity.Position()
+	if !ok {
+		return nil, nil, Reject(move, ReasonNoComponent, "entity %s has no position", move.SourceID)
+	}
+
+	xDiff := float64(sourcePosition.X - move.Position.X)
+	yDiff := float64(sourcePosition.Y - move.Position.Y)
 
 	if math.Abs(xDiff) > 1 || math.Abs(yDiff) > 1 {
-		panic(errs.Errorf("desired Move position is too far away"))
+		return nil, nil, Reject(move, ReasonTooFar, "desired Move position is too far away")
 	}
 
 	entitiesAtPosition, _ := locker.GetByPosition(move.Position)
 
 	for _, entity := range entitiesAtPosition {
 		if entity.ID == sourceEntity.ID {
-			panic("cannot move to where you are already at")
+			return nil, nil, Reject(move, ReasonAlreadyThere, "cannot move to where you are already at")
 		}
-		if !entity.Spatial.Stackable {
-			return nil, nil
+		if entity.Blocks() {
+			return nil, nil, Reject(move, ReasonBlocked, "position is occupied")
 		}
 	}
 
@@ -91,36 +246,38 @@ func (move Move) Compute(locker *entities.Locker) ([]actions.Action, []pubsub.No
 
 	moveFrom := actions.MoveFrom{
 		SourceID: move.SourceID,
-		Position: sourceEntity.Position,
+		Position: sourcePosition,
 	}
 
+	// The mover's own subscribers always cover both positions, so it is not
+	// notified on its entity topic as well; doing so would repeat each action.
 	serverMutations := []actions.Action{moveTo, moveFrom}
 	notifications := []pubsub.Notification{
 		pubsub.Notification{
-			Type:    move.Position,
+			Topic:   pubsub.PositionTopic(move.Position),
 			Actions: []actions.Action{moveTo},
 		},
 		pubsub.Notification{
-			Type:    sourceEntity.Position,
+			Topic:   pubsub.PositionTopic(sourcePosition),
 			Actions: []actions.Action{moveFrom},
 		},
-		pubsub.Notification{
-			Type:    sourceEntity.ID,
-			Actions: []actions.Action{moveTo, moveFrom},
-		},
 	}
 
-	return serverMutations, notifications
+	return serverMutations, notifications, nil
 }
 
 type Info struct {
 	SourceID uuid.UUID
 }
 
-func (info Info) Compute(locker *entities.Locker) ([]actions.Action, []pubsub.Notification) {
+func (info Info) Source() uuid.UUID {
+	return info.SourceID
+}
+
+func (info Info) Compute(locker *entities.Locker) ([]actions.Action, []pubsub.Notification, *Rejection) {
 	sourceEntity, err := locker.GetByID(info.SourceID)
 	if err != nil {
-		panic("compute info went wrong")
+		return nil, nil, Reject(info, ReasonUnknownEntity, "could not locate entity %s", info.SourceID)
 	}
 
 	inform := actions.SetEntity{
@@ -129,60 +286,136 @@ func (info Info) Compute(locker *entities.Locker) ([]actions.Action, []pubsub.No
 
 	notifications := []pubsub.Notification{
 		pubsub.Notification{
-			Type:    info.SourceID,
+			Topic:   pubsub.EntityTopic(info.SourceID),
 			Actions: []actions.Action{inform},
 		},
 	}
 
-	return nil, notifications
+	return nil, notifications, nil
 }
 
+// DefaultVisionRadius is how far entities without a Vision component see.
+const DefaultVisionRadius = 5
+
+// Perceive informs the source entity's client of every entity within its
+// field of view. Entities which block movement also block sight.
+//
+// When Memory is set, only entities which are new to the client or have
+// changed are sent, along with removals for those no longer in view;
+// otherwise the client's locker is cleared and sent everything in view.
 type Perceive struct {
 	SourceID uuid.UUID
+
+	Memory *Memory `json:"-"`
+}
+
+func (command Perceive) Source() uuid.UUID {
+	return command.SourceID
 }
 
-func (command Perceive) Compute(locker *entities.Locker) ([]actions.Action, []pubsub.Notification) {
+func (command Perceive) Compute(locker *entities.Locker) ([]actions.Action, []pubsub.Notification, *Rejection) {
 	sourceEntity, err := locker.GetByID(command.SourceID)
 	if err != nil {
-		fmt.Printf("%+v\n", err)
-		os.Exit(1)
+		return nil, nil, Reject(command, ReasonUnknownEntity, "could not locate entity %s", command.SourceID)
+	}
+	sourcePosition, ok := sourceEntity.Position()
+	if !ok {
+		return nil, nil, Reject(command, ReasonNoComponent, "entity %s has no position", command.SourceID)
+	}
+
+	radius := DefaultVisionRadius
+	var vision components.Vision
+	if sourceEntity.Get(&vision) {
+		radius = vision.Radius
 	}
-	sourcePosition := sourceEntity.Position
 
-	visibility := 5
-	minX := sourcePosition.X - visibility
-	maxX := sourcePosition.X + visibility
+	opaque := func(pos components.Position) bool {
+		entitiesAtPosition, _ := locker.GetByPosition(pos)
+		for _, e := range entitiesAtPosition {
+			if e.Blocks() {
+				return true
+			}
+		}
+		return false
+	}
 
-	minY := sourcePosition.Y - visibility
-	maxY := sourcePosition.Y + visibility
+	visible := make([]entities.Entity, 0)
 
-	muts := make([]actions.Action, 0)
+	for pos := range fov.Compute(sourcePosition, radius, opaque) {
+		entitiesAtPosition, _ := locker.GetByPosition(pos)
+		visible = append(visible, entitiesAtPosition...)
+	}
 
-	for x := minX; x <= maxX; x++ {
-		for y := minY; y <= maxY; y++ {
-			entitiesAtPosition, _ := locker.GetByPosition(components.Position{x, y})
+	if command.Memory == nil {
+		muts := make([]actions.Action, 0, len(visible))
+		for _, e := range visible {
+			muts = append(muts, actions.SetEntity{Entity: e})
+		}
 
-			for _, e := range entitiesAtPosition {
-				muts = append(
-					muts,
-					actions.SetEntity{Entity: e},
-				)
-			}
+		notifications := []pubsub.Notification{
+			pubsub.Notification{
+				Topic:   pubsub.EntityTopic(command.SourceID),
+				Actions: []actions.Action{actions.ClearAllEntities{}},
+			},
+			pubsub.Notification{
+				Topic:   pubsub.EntityTopic(command.SourceID),
+				Actions: muts,
+			},
 		}
+
+		return nil, notifications, nil
+	}
+
+	changed, removed := command.Memory.update(command.SourceID, visible)
+	if len(changed) == 0 && len(removed) == 0 {
+		return nil, nil, nil
+	}
+
+	muts := make([]actions.Action, 0, len(changed)+len(removed))
+	for _, id := range removed {
+		muts = append(muts, actions.RemoveEntity{ID: id})
+	}
+	for _, e := range changed {
+		muts = append(muts, actions.SetEntity{Entity: e})
 	}
 
 	notifications := []pubsub.Notification{
 		pubsub.Notification{
-			Type:    command.SourceID,
-			Actions: []actions.Action{actions.ClearAllEntities{}},
-		},
-		pubsub.Notification{
-			Type:    command.SourceID,
+			Topic:   pubsub.EntityTopic(command.SourceID),
 			Actions: muts,
 		},
 	}
 
-	return nil, notifications
+	return nil, notifications, nil
+}
+
+// toggleNotifications announces a change to the target's stackability to
+// everyone near it. A target without a position is only announced to
+// itself and the source.
+func toggleNotifications(
+	sourceID uuid.UUID,
+	target entities.Entity,
+	mutate actions.SetStackability,
+) []pubsub.Notification {
+	if pos, ok := target.Position(); ok {
+		return []pubsub.Notification{
+			pubsub.Notification{
+				Topic:   pubsub.PositionTopic(pos),
+				Actions: []actions.Action{mutate},
+			},
+		}
+	}
+
+	return []pubsub.Notification{
+		pubsub.Notification{
+			Topic:   pubsub.EntityTopic(target.ID),
+			Actions: []actions.Action{mutate},
+		},
+		pubsub.Notification{
+			Topic:   pubsub.EntityTopic(sourceID),
+			Actions: []actions.Action{mutate},
+		},
+	}
 }
 
 type OpenSpatial struct {
@@ -190,29 +423,34 @@ type OpenSpatial struct {
 	TargetID uuid.UUID
 }
 
-func (command OpenSpatial) Compute(locker *entities.Locker) ([]actions.Action, []pubsub.Notification) {
+func (command OpenSpatial) Source() uuid.UUID {
+	return command.SourceID
+}
+
+func (command OpenSpatial) Compute(locker *entities.Locker) ([]actions.Action, []pubsub.Notification, *Rejection) {
 	if uuid.Equal(command.SourceID, command.TargetID) {
-		panic("cannot open yourself I think")
+		return nil, nil, Reject(command, ReasonSelfTarget, "cannot open yourself")
 	}
 
 	_, err := locker.GetByID(command.SourceID)
 	if err != nil {
-		panic("compute info went wrong")
+		return nil, nil, Reject(command, ReasonUnknownEntity, "could not locate entity %s", command.SourceID)
 	}
 
 	targetEntity, err := locker.GetByID(command.TargetID)
 	if err != nil {
-		panic("compute OpenSpatial went wrong")
+		return nil, nil, Reject(command, ReasonUnknownEntity, "could not locate target %s", command.TargetID)
 	}
 
 	// If target is not toggleable, do nothing.
-	if !targetEntity.Spatial.Toggleable {
-		return nil, nil
+	spatial, ok := targetEntity.Spatial()
+	if !ok || !spatial.Toggleable {
+		return nil, nil, nil
 	}
 
 	// If target is already passable, do nothing.
-	if targetEntity.Spatial.Stackable {
-		return nil, nil
+	if spatial.Stackable {
+		return nil, nil, nil
 	}
 
 	mutate := actions.SetStackability{
@@ -220,18 +458,8 @@ func (command OpenSpatial) Compute(locker *entities.Locker) ([]actions.Action, [
 		Stackability: true,
 	}
 
-	notifications := []pubsub.Notification{
-		pubsub.Notification{
-			Type:    command.TargetID,
-			Actions: []actions.Action{mutate},
-		},
-		pubsub.Notification{
-			Type:    command.SourceID,
-			Actions: []actions.Action{mutate},
-		},
-	}
-
-	return []actions.Action{mutate}, notifications
+	notifications := toggleNotifications(command.SourceID, targetEntity, mutate)
+	return []actions.Action{mutate}, notifications, nil
 }
 
 type CloseSpatial struct {
@@ -239,38 +467,37 @@ type CloseSpatial struct {
 	TargetID uuid.UUID
 }
 
-func (command CloseSpatial) Compute(locker *entities.Locker) ([]actions.Action, []pubsub.Notification) {
-	sourceEntity, err := locker.GetByID(command.SourceID)
+func (command CloseSpatial) Source() uuid.UUID {
+	return command.SourceID
+}
+
+func (command CloseSpatial) Compute(locker *entities.Locker) ([]actions.Action, []pubsub.Notification, *Rejection) {
+	_, err := locker.GetByID(command.SourceID)
 	if err != nil {
-		panic("compute info went wrong")
+		return nil, nil, Reject(command, ReasonUnknownEntity, "could not locate entity %s", command.SourceID)
 	}
 
 	targetEntity, err := locker.GetByID(command.TargetID)
 	if err != nil {
-		panic("compute info went wrong")
+		return nil, nil, Reject(command, ReasonUnknownEntity, "could not locate target %s", command.TargetID)
 	}
 
 	// If target is not toggleable, do nothing.
-	if !targetEntity.Spatial.Toggleable {
-		return nil, nil
+	spatial, ok := targetEntity.Spatial()
+	if !ok || !spatial.Toggleable {
+		return nil, nil, nil
 	}
 
 	// If target is already not passable, do nothing.
-	if !targetEntity.Spatial.Stackable {
-		return nil, nil
+	if !spatial.Stackable {
+		return nil, nil, nil
 	}
 
 	mutate := actions.SetStackability{
-		Entity:       sourceEntity,
+		Entity:       targetEntity,
 		Stackability: false,
 	}
 
-	notifications := []pubsub.Notification{
-		pubsub.Notification{
-			Type:    command.TargetID,
-			Actions: []actions.Action{mutate},
-		},
-	}
-
-	return nil, notifications
+	notifications := toggleNotifications(command.SourceID, targetEntity, mutate)
+	return []actions.Action{mutate}, notifications, nil
 }
@@ -0,0 +1,62 @@
+package commands
+
+import (
+	"sync"
+
+	"github.com/clagraff/devoid/entities"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Memory records which entities, at which versions, each observer was last
+// told about, so Perceive can send only what has changed since.
+type Memory struct {
+	mux  *sync.Mutex
+	seen map[uuid.UUID]map[uuid.UUID]uint64
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		mux:  new(sync.Mutex),
+		seen: make(map[uuid.UUID]map[uuid.UUID]uint64),
+	}
+}
+
+// Forget discards everything remembered for observer, so its next Perceive
+// is sent in full.
+func (m *Memory) Forget(observer uuid.UUID) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	delete(m.seen, observer)
+}
+
+// update records visible as everything observer now knows about, returning
+// the entities which are new or have changed, and the IDs of previously
+// seen entities which are no longer visible.
+func (m *Memory) update(observer uuid.UUID, visible []entities.Entity) ([]entities.Entity, []uuid.UUID) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	previous := m.seen[observer]
+	current := make(map[uuid.UUID]uint64, len(visible))
+	changed := make([]entities.Entity, 0)
+
+	for _, entity := range visible {
+		current[entity.ID] = entity.Version
+
+		if version, ok := previous[entity.ID]; !ok || version != entity.Version {
+			changed = append(changed, entity)
+		}
+	}
+
+	removed := make([]uuid.UUID, 0)
+	for id := range previous {
+		if _, ok := current[id]; !ok {
+			removed = append(removed, id)
+		}
+	}
+
+	m.seen[observer] = current
+	return changed, removed
+}
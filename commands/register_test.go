@@ -0,0 +1,39 @@
+package commands_test
+
+import (
+	"testing"
+
+	"github.com/clagraff/devoid/actions"
+	"github.com/clagraff/devoid/commands"
+	"github.com/clagraff/devoid/entities"
+	"github.com/clagraff/devoid/pubsub"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// shout only implements Command through its pointer.
+type shout struct {
+	SourceID uuid.UUID
+}
+
+func (s *shout) Source() uuid.UUID {
+	return s.SourceID
+}
+
+func (s *shout) Compute(*entities.Locker) ([]actions.Action, []pubsub.Notification, *commands.Rejection) {
+	return nil, nil, nil
+}
+
+func TestRegisterRejectsPointerReceivers(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering a pointer-receiver command to panic")
+		}
+
+		if _, err := commands.Decode("shout", func(interface{}) error { return nil }); err == nil {
+			t.Error("a command which failed to register can still be decoded")
+		}
+	}()
+
+	commands.Register("shout", func() commands.Command { return new(shout) })
+}
@@ -9,6 +9,14 @@ type Spatial struct {
 	Toggleable bool
 }
 
+// Vision determines how far an entity can see.
+type Vision struct {
+	Radius int
+}
+
+// Spawn marks a position at which new players may be placed.
+type Spawn struct{}
+
 // Position represents the absolute 2D position of an entity.
 type Position struct {
 	X int
@@ -0,0 +1,286 @@
+package components
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/clagraff/devoid/wire"
+
+	errs "github.com/go-errors/errors"
+)
+
+// Component is a piece of data which may be attached to an entity.
+// Components should be plain values, as they are copied along with the
+// entities they are attached to.
+type Component interface{}
+
+// registry maps component names to their types, and types back to names.
+var registry = struct {
+	mux    sync.RWMutex
+	byName map[string]reflect.Type
+	byType map[reflect.Type]string
+}{
+	byName: make(map[string]reflect.Type),
+	byType: make(map[reflect.Type]string),
+}
+
+// Register makes the type of prototype available as a component under the
+// provided name, which is also its key when serialized. Register panics if
+// the name or type is already registered.
+func Register(name string, prototype Component) {
+	registry.mux.Lock()
+	defer registry.mux.Unlock()
+
+	kind := reflect.TypeOf(prototype)
+	if kind == nil || kind.Kind() == reflect.Ptr {
+		panic(errs.Errorf("component %s must be registered with a non-pointer value", name))
+	}
+
+	if _, ok := registry.byName[name]; ok {
+		panic(errs.Errorf("component %s is already registered", name))
+	}
+
+	if other, ok := registry.byType[kind]; ok {
+		panic(errs.Errorf("%s is already registered as component %s", kind, other))
+	}
+
+	registry.byName[name] = kind
+	registry.byType[kind] = name
+}
+
+// NameOf returns the name the component's type is registered under.
+func NameOf(component Component) (string, error) {
+	registry.mux.RLock()
+	defer registry.mux.RUnlock()
+
+	name, ok := registry.byType[reflect.TypeOf(component)]
+	if !ok {
+		return "", fmt.Errorf("unregistered component type %T", component)
+	}
+
+	return name, nil
+}
+
+func mustNameOf(component Component) string {
+	name, err := NameOf(component)
+	if err != nil {
+		panic(err)
+	}
+
+	return name
+}
+
+// Decode unmarshals raw JSON into a new component of the type registered
+// under name.
+func Decode(name string, raw []byte) (Component, error) {
+	registry.mux.RLock()
+	kind, ok := registry.byName[name]
+	registry.mux.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown component %s", name)
+	}
+
+	ptr := reflect.New(kind)
+	if err := json.Unmarshal(raw, ptr.Interface()); err != nil {
+		return nil, fmt.Errorf("invalid component %s: %v", name, err)
+	}
+
+	return ptr.Elem().Interface(), nil
+}
+
+// Override unmarshals raw JSON on top of a copy of base, so fields absent
+// from raw keep base's values.
+func Override(base Component, raw []byte) (Component, error) {
+	name, err := NameOf(base)
+	if err != nil {
+		return nil, err
+	}
+
+	ptr := reflect.New(reflect.TypeOf(base))
+	ptr.Elem().Set(reflect.ValueOf(base))
+
+	if err := json.Unmarshal(raw, ptr.Interface()); err != nil {
+		return nil, fmt.Errorf("invalid component %s: %v", name, err)
+	}
+
+	return ptr.Elem().Interface(), nil
+}
+
+// Set holds at most one component of each registered type. A Set is never
+// modified in place; With and Without return modified copies, so Sets may
+// be shared freely between copies of an entity. The zero value is empty.
+type Set struct {
+	byName map[string]Component
+}
+
+// MakeSet returns a Set holding the provided components.
+func MakeSet(components ...Component) Set {
+	return Set{}.With(components...)
+}
+
+// With returns a copy of the set holding the provided components, replacing
+// any of the same types. It panics if a component type is not registered.
+func (s Set) With(components ...Component) Set {
+	byName := make(map[string]Component, len(s.byName)+len(components))
+	for name, component := range s.byName {
+		byName[name] = component
+	}
+
+	for _, component := range components {
+		byName[mustNameOf(component)] = component
+	}
+
+	return Set{byName: byName}
+}
+
+// Without returns a copy of the set without components of the types of
+// the provided prototypes.
+func (s Set) Without(prototypes ...Component) Set {
+	byName := make(map[string]Component, len(s.byName))
+	for name, component := range s.byName {
+		byName[name] = component
+	}
+
+	for _, prototype := range prototypes {
+		delete(byName, mustNameOf(prototype))
+	}
+
+	return Set{byName: byName}
+}
+
+// Get copies the component of ptr's element type into ptr, reporting
+// whether the set holds one. ptr must be a pointer to a registered
+// component type.
+func (s Set) Get(ptr interface{}) bool {
+	value := reflect.ValueOf(ptr)
+	if value.Kind() != reflect.Ptr || value.IsNil() {
+		panic(errs.Errorf("Get requires a non-nil pointer, not %T", ptr))
+	}
+
+	component, ok := s.byName[mustNameOf(value.Elem().Interface())]
+	if ok {
+		value.Elem().Set(reflect.ValueOf(component))
+	}
+
+	return ok
+}
+
+// Has reports whether the set holds a component of the type of every
+// provided prototype.
+func (s Set) Has(prototypes ...Component) bool {
+	for _, prototype := range prototypes {
+		if _, ok := s.byName[mustNameOf(prototype)]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Len returns the number of components in the set.
+func (s Set) Len() int {
+	return len(s.byName)
+}
+
+// Names returns the names of the components in the set, in sorted order.
+func (s Set) Names() []string {
+	names := make([]string, 0, len(s.byName))
+	for name := range s.byName {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Lookup returns the component registered under name, if the set holds one.
+func (s Set) Lookup(name string) (Component, bool) {
+	component, ok := s.byName[name]
+	return component, ok
+}
+
+func (s Set) MarshalJSON() ([]byte, error) {
+	if s.byName == nil {
+		return []byte("{}"), nil
+	}
+
+	return json.Marshal(s.byName)
+}
+
+func (s *Set) UnmarshalJSON(bytes []byte) error {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(bytes, &fields); err != nil {
+		return err
+	}
+
+	byName := make(map[string]Component, len(fields))
+	for name, raw := range fields {
+		component, err := Decode(name, raw)
+		if err != nil {
+			return err
+		}
+		byName[name] = component
+	}
+
+	s.byName = byName
+	return nil
+}
+
+// wireComponent is how each component of a Set is wire encoded.
+type wireComponent struct {
+	Name string
+	Data []byte
+}
+
+// MarshalBinary encodes the set in the compact wire format, as each
+// component's registered name followed by its own encoding.
+func (s Set) MarshalBinary() ([]byte, error) {
+	encoded := make([]wireComponent, 0, len(s.byName))
+	for _, name := range s.Names() {
+		data, err := wire.Marshal(s.byName[name])
+		if err != nil {
+			return nil, fmt.Errorf("invalid component %s: %v", name, err)
+		}
+		encoded = append(encoded, wireComponent{Name: name, Data: data})
+	}
+
+	return wire.Marshal(encoded)
+}
+
+func (s *Set) UnmarshalBinary(data []byte) error {
+	encoded := make([]wireComponent, 0)
+	if err := wire.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+
+	byName := make(map[string]Component, len(encoded))
+	for _, component := range encoded {
+		registry.mux.RLock()
+		kind, ok := registry.byName[component.Name]
+		registry.mux.RUnlock()
+
+		if !ok {
+			return fmt.Errorf("unknown component %s", component.Name)
+		}
+
+		ptr := reflect.New(kind)
+		if err := wire.Unmarshal(component.Data, ptr.Interface()); err != nil {
+			return fmt.Errorf("invalid component %s: %v", component.Name, err)
+		}
+		byName[component.Name] = ptr.Elem().Interface()
+	}
+
+	s.byName = byName
+	return nil
+}
+
+func init() {
+	Register("Position", Position{})
+	Register("Spatial", Spatial{})
+	Register("Spawn", Spawn{})
+	Register("Vision", Vision{})
+}
@@ -1,14 +1,112 @@
 package entities
 
 import (
+	"encoding/json"
+
 	"github.com/clagraff/devoid/components"
+	"github.com/pkg/errors"
 
 	uuid "github.com/satori/go.uuid"
 )
 
+// Entity is an ID, and the components attached to it. When serialized, an
+// entity's components appear alongside its ID, keyed by component name.
 type Entity struct {
 	ID uuid.UUID
 
-	Position components.Position
-	Spatial  components.Spatial
+	// Version is incremented by the Locker every time the entity is stored.
+	Version uint64
+
+	Components components.Set
+}
+
+// Get copies the entity's component of ptr's element type into ptr,
+// reporting whether the entity has one.
+func (e Entity) Get(ptr interface{}) bool {
+	return e.Components.Get(ptr)
+}
+
+// Has reports whether the entity has a component of the type of every
+// provided prototype.
+func (e Entity) Has(prototypes ...components.Component) bool {
+	return e.Components.Has(prototypes...)
+}
+
+// Attach adds the provided components to the entity, replacing any of the
+// same types.
+func (e *Entity) Attach(attached ...components.Component) {
+	e.Components = e.Components.With(attached...)
+}
+
+// Detach removes components of the types of the provided prototypes.
+func (e *Entity) Detach(prototypes ...components.Component) {
+	e.Components = e.Components.Without(prototypes...)
+}
+
+// Position returns the entity's Position component, if it has one.
+func (e Entity) Position() (components.Position, bool) {
+	var pos components.Position
+	ok := e.Get(&pos)
+	return pos, ok
+}
+
+// Spatial returns the entity's Spatial component, if it has one.
+func (e Entity) Spatial() (components.Spatial, bool) {
+	var spatial components.Spatial
+	ok := e.Get(&spatial)
+	return spatial, ok
+}
+
+// Blocks reports whether the entity prevents others from sharing its
+// position. Entities without a Spatial component never block.
+func (e Entity) Blocks() bool {
+	spatial, ok := e.Spatial()
+	return ok && !spatial.Stackable
+}
+
+func (e Entity) MarshalJSON() ([]byte, error) {
+	fields := make(map[string]interface{}, e.Components.Len()+2)
+	for _, name := range e.Components.Names() {
+		fields[name], _ = e.Components.Lookup(name)
+	}
+
+	fields["ID"] = e.ID
+	fields["Version"] = e.Version
+
+	return json.Marshal(fields)
+}
+
+func (e *Entity) UnmarshalJSON(bytes []byte) error {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(bytes, &fields); err != nil {
+		return err
+	}
+
+	entity := Entity{}
+
+	if raw, ok := fields["ID"]; ok {
+		if err := json.Unmarshal(raw, &entity.ID); err != nil {
+			return errors.Wrap(err, "invalid entity ID")
+		}
+		delete(fields, "ID")
+	}
+
+	if raw, ok := fields["Version"]; ok {
+		if err := json.Unmarshal(raw, &entity.Version); err != nil {
+			return errors.Wrapf(err, "invalid version for entity %s", entity.ID)
+		}
+		delete(fields, "Version")
+	}
+
+	rawComponents, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal(rawComponents, &entity.Components); err != nil {
+		return errors.Wrapf(err, "invalid components for entity %s", entity.ID)
+	}
+
+	*e = entity
+	return nil
 }
@@ -3,6 +3,9 @@ package entities
 import (
 	"encoding/json"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
 	"sync"
 
 	"github.com/clagraff/devoid/components"
@@ -10,231 +13,279 @@ import (
 	uuid "github.com/satori/go.uuid"
 )
 
-type Container interface {
-	Get() Entity
-	Set(Entity)
-}
+// idContainer is a map of UUID ID to Entity. It is not safe for concurrent
+// use; the owning Locker's lock must be held.
+type idContainer map[uuid.UUID]Entity
+
+// All returns a list of Entity stored in this map.
+func (c idContainer) All() []Entity {
+	allEntities := make([]Entity, 0, len(c))
+	for _, entity := range c {
+		allEntities = append(allEntities, entity)
+	}
 
-type container struct {
-	mux    *sync.RWMutex
-	entity *Entity
+	return allEntities
 }
 
-func (c container) Get() Entity {
-	c.mux.RLock()
-	defer c.mux.RUnlock()
+// Query returns every Entity which has a component of the type of each
+// provided prototype.
+func (c idContainer) Query(prototypes ...components.Component) []Entity {
+	matching := make([]Entity, 0)
+	for _, entity := range c {
+		if entity.Has(prototypes...) {
+			matching = append(matching, entity)
+		}
+	}
 
-	return *c.entity
+	return matching
 }
 
-func (c *container) Set(entity Entity) {
-	c.mux.Lock()
-	defer c.mux.Unlock()
+// posContainer is a map of components.Position to the IDs of the entities
+// at that position. It is not safe for concurrent use; the owning Locker's
+// lock must be held.
+type posContainer map[components.Position]map[uuid.UUID]struct{}
 
-	*c.entity = entity
+// Add records id as being at the provided position.
+func (c posContainer) Add(pos components.Position, id uuid.UUID) {
+	ids, ok := c[pos]
+	if !ok {
+		ids = make(map[uuid.UUID]struct{})
+		c[pos] = ids
+	}
+
+	ids[id] = struct{}{}
 }
 
-func newContainer() Container {
-	return &container{
-		mux:    new(sync.RWMutex),
-		entity: new(Entity),
+// Remove forgets id being at the provided position, if it was.
+func (c posContainer) Remove(pos components.Position, id uuid.UUID) {
+	ids, ok := c[pos]
+	if !ok {
+		return
 	}
-}
 
-// idContainer is a concurrent-use map of UUID ID to Container.
-type idContainer struct {
-	internal *sync.Map
+	delete(ids, id)
+	if len(ids) == 0 {
+		delete(c, pos)
+	}
 }
 
-// Delete the Container at the provided ID if present, or do nothing.
-func (c idContainer) Delete(id uuid.UUID) {
-	c.internal.Delete(id)
+// Locker stores entities indexed by both ID and position. A single
+// locker-wide lock guards both indexes, so readers never observe an entity
+// at two positions, or at none.
+type Locker struct {
+	mux   *sync.RWMutex
+	byID  idContainer
+	byPos posContainer
 }
 
-// Load returns the Container for the provided id, with a boolean
-// indicating success.
-func (c idContainer) Load(id uuid.UUID) (Container, bool) {
-	var container Container
+func (l Locker) All() []Entity {
+	l.mux.RLock()
+	defer l.mux.RUnlock()
 
-	value, ok := c.internal.Load(id)
-	if ok {
-		container = value.(Container)
-	}
+	return l.byID.All()
+}
 
-	return container, ok
+func (l Locker) GetByID(id uuid.UUID) (Entity, error) {
+	l.mux.RLock()
+	defer l.mux.RUnlock()
+
+	return l.get(id)
 }
 
-// Store will save the provided Container at the given id; this will
-// override any previous value stored at that id.
-func (c idContainer) Store(id uuid.UUID, container Container) {
-	c.internal.Store(id, container)
+func (l Locker) GetByPosition(pos components.Position) ([]Entity, error) {
+	l.mux.RLock()
+	defer l.mux.RUnlock()
+
+	return l.getByPosition(pos)
 }
 
-// All returns a list of Container stored in this map.
-// Modifications to the map while this function runs may impact the results.
-func (c idContainer) All() []Entity {
-	allContainers := make([]Entity, 0)
+// getByPosition returns the entities at pos. The lock must be held.
+func (l *Locker) getByPosition(pos components.Position) ([]Entity, error) {
+	ids, ok := l.byPos[pos]
+	if !ok {
+		return nil, errors.Errorf("no position for %+v", pos)
+	}
 
-	ranger := func(key, value interface{}) bool {
-		if ec, ok := value.(Container); ok {
-			allContainers = append(allContainers, ec.Get())
-		}
-		return true
+	entitiesAtPosition := make([]Entity, 0, len(ids))
+	for id := range ids {
+		entitiesAtPosition = append(entitiesAtPosition, l.byID[id])
 	}
 
-	c.internal.Range(ranger)
-	return allContainers
+	return entitiesAtPosition, nil
 }
 
-// makeIDContainer returns an instantiated idContainer.
-func makeIDContainer() idContainer {
-	return idContainer{
-		internal: new(sync.Map),
-	}
+// Query returns every entity which has a component of the type of each
+// provided prototype.
+func (l Locker) Query(prototypes ...components.Component) []Entity {
+	l.mux.RLock()
+	defer l.mux.RUnlock()
+
+	return l.byID.Query(prototypes...)
 }
 
-// posContainer is a concurrent-use map of components.Position to idContainer.
-type posContainer struct {
-	internal *sync.Map
+// ErrVersionConflict is the cause of errors returned by CompareAndSet when
+// the stored entity has changed since the provided copy was read.
+var ErrVersionConflict = errors.New("entity version conflict")
+
+// IsVersionConflict reports whether err was caused by a version conflict.
+func IsVersionConflict(err error) bool {
+	return errors.Cause(err) == ErrVersionConflict
 }
 
-// Delete the idContainer at the provided position if present, or do nothing.
-func (c posContainer) Delete(pos components.Position) {
-	c.internal.Delete(pos)
+// CompareAndSet stores entity only if the stored copy still has the same
+// Version as entity, meaning nothing has modified it since it was read.
+func (l *Locker) CompareAndSet(entity Entity) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	return l.compareAndSet(entity)
 }
 
-// Load returns the idContainer for the provided position, with a boolean
-// indicating success.
-func (c posContainer) Load(pos components.Position) (idContainer, bool) {
-	var container idContainer
+// compareAndSet implements CompareAndSet. The write lock must be held.
+func (l *Locker) compareAndSet(entity Entity) error {
+	current, err := l.get(entity.ID)
+	if err != nil {
+		return err
+	}
 
-	value, ok := c.internal.Load(pos)
-	if ok {
-		container = value.(idContainer)
+	if current.Version != entity.Version {
+		return errors.Wrapf(
+			ErrVersionConflict,
+			"entity %s is at version %d, not %d",
+			entity.ID,
+			current.Version,
+			entity.Version,
+		)
 	}
 
-	return container, ok
+	l.set(entity)
+	return nil
 }
 
-// Store will save the provided idContainer at the given position; this will
-// override any previous value stored at that position.
-func (c posContainer) Store(pos components.Position, container idContainer) {
-	c.internal.Store(pos, container)
-}
+// Set stores entity, overwriting any stored copy. The stored entity is
+// given a Version greater than both its previous and provided versions.
+func (l *Locker) Set(entity Entity) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
 
-// makePosContainer returns an instantiated posContainer.
-func makePosContainer() posContainer {
-	return posContainer{
-		internal: new(sync.Map),
-	}
+	l.set(entity)
+	return nil
 }
 
-type Locker struct {
-	byID  *idContainer
-	byPos *posContainer
-}
+// Update atomically reads the entity with the provided id, passes it to fn
+// for modification, and stores the result. Nothing is stored if fn returns
+// an error.
+func (l *Locker) Update(id uuid.UUID, fn func(*Entity) error) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
 
-func (l Locker) All() []Entity {
-	return l.byID.All()
+	return l.update(id, fn)
 }
 
-func (l Locker) GetByID(id uuid.UUID) (Entity, error) {
-	container, ok := l.byID.Load(id)
-	if !ok {
-		return Entity{}, errors.Errorf("no entity with id %s", id)
+// update implements Update. The write lock must be held.
+func (l *Locker) update(id uuid.UUID, fn func(*Entity) error) error {
+	entity, err := l.get(id)
+	if err != nil {
+		return err
 	}
 
-	return container.Get(), nil
-}
-
-func (l Locker) GetByPosition(pos components.Position) ([]Entity, error) {
-	entitiesAtPosition, ok := l.byPos.Load(pos)
-	if !ok {
-		return nil, errors.Errorf("no position for %s", pos)
+	if err = fn(&entity); err != nil {
+		return err
 	}
 
-	return entitiesAtPosition.All(), nil
+	entity.ID = id
+	l.set(entity)
+	return nil
 }
 
-func (l *Locker) Set(entity Entity) error {
-	// Grab the entity and lock it.
-	id := entity.ID
+func (l *Locker) Delete(id uuid.UUID) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
 
-	container, ok := l.byID.Load(id)
-	if !ok {
-		container = newContainer()
-		container.Set(entity)
-	}
+	return l.delete(id)
+}
 
-	// Grab old version. Check if position differs.
+// DeleteFromPos removes a stale position index entry for id. Entities are
+// never removed from the position they currently occupy.
+func (l *Locker) DeleteFromPos(id uuid.UUID, pos components.Position) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
 
-	oldEntity := container.Get()
-	oldPos := oldEntity.Position
+	return l.deleteFromPos(id, pos)
+}
 
-	// If position changed, remove from old pos.
-	if (oldPos.X != entity.Position.X) || (oldPos.Y != entity.Position.Y) {
-		ids, ok := l.byPos.Load(oldPos)
-		if !ok {
-			return errors.Errorf("no position %+v", oldPos)
+// deleteFromPos implements DeleteFromPos. The write lock must be held.
+func (l *Locker) deleteFromPos(id uuid.UUID, pos components.Position) error {
+	if entity, ok := l.byID[id]; ok {
+		if current, ok := entity.Position(); ok && current == pos {
+			return nil
 		}
-		ids.Delete(id)
 	}
 
-	// Update entity contents in container. Update in ID store.
-	container.Set(entity)
-	l.byID.Store(id, container)
-
-	// Update in position store.
-	newPos := entity.Position
+	l.byPos.Remove(pos, id)
+	return nil
+}
 
-	ids, ok := l.byPos.Load(newPos)
-	if !ok {
-		ids = makeIDContainer()
-	}
+func (l *Locker) DeleteAll() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
 
-	ids.Store(id, container)
+	l.deleteAll()
+}
 
-	l.byPos.Store(newPos, ids)
-	return nil
+// deleteAll removes every entity. The write lock must be held.
+func (l *Locker) deleteAll() {
+	for id := range l.byID {
+		l.delete(id)
+	}
 }
 
-func (l *Locker) Delete(id uuid.UUID) error {
-	container, ok := l.byID.Load(id)
+// get returns the entity with the provided id. The lock must be held.
+func (l *Locker) get(id uuid.UUID) (Entity, error) {
+	entity, ok := l.byID[id]
 	if !ok {
-		return errors.Errorf("no entity with id %s", id)
+		return Entity{}, errors.Errorf("no entity with id %s", id)
 	}
 
-	position := container.Get().Position
+	return entity, nil
+}
 
-	entitiesAtPosition, ok := l.byPos.Load(position)
-	if ok {
-		entitiesAtPosition.Delete(id)
-		l.byPos.Store(position, entitiesAtPosition)
+// set stores entity in both indexes. The write lock must be held.
+func (l *Locker) set(entity Entity) {
+	if old, ok := l.byID[entity.ID]; ok {
+		if old.Version > entity.Version {
+			entity.Version = old.Version
+		}
+		if pos, ok := old.Position(); ok {
+			l.byPos.Remove(pos, entity.ID)
+		}
 	}
 
-	l.byID.Delete(id)
-
-	return nil
+	entity.Version++
+	l.byID[entity.ID] = entity
+	if pos, ok := entity.Position(); ok {
+		l.byPos.Add(pos, entity.ID)
+	}
 }
 
-func (l *Locker) DeleteFromPos(id uuid.UUID, pos components.Position) error {
-	entitiesAtPosition, ok := l.byPos.Load(pos)
-	if ok {
-		entitiesAtPosition.Delete(id)
-		l.byPos.Store(pos, entitiesAtPosition)
+// delete removes the entity from both indexes. The write lock must be held.
+func (l *Locker) delete(id uuid.UUID) error {
+	entity, ok := l.byID[id]
+	if !ok {
+		return errors.Errorf("no entity with id %s", id)
 	}
 
-	return nil
-}
-
-func (l *Locker) DeleteAll() {
-	currentEntities := l.byID.All()
-	for _, e := range currentEntities {
-		l.Delete(e.ID)
+	if pos, ok := entity.Position(); ok {
+		l.byPos.Remove(pos, id)
 	}
+	delete(l.byID, id)
+
+	return nil
 }
 
-func (l *Locker) FromJSONFile(path string) error {
+// FromJSONFile loads every entity listed in the JSON file at path. Entries
+// may reference the provided prefabs, which may be nil.
+func (l *Locker) FromJSONFile(path string, prefabs Prefabs) error {
 	// try to read the file
 	bytes, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -242,24 +293,74 @@ func (l *Locker) FromJSONFile(path string) error {
 	}
 
 	// try to unmarshal into entity list
-	allEntities := make([]Entity, 0)
-	err = json.Unmarshal(bytes, &allEntities)
+	entries := make([]json.RawMessage, 0)
+	err = json.Unmarshal(bytes, &entries)
 	if err != nil {
 		return errors.Wrapf(err, "not a valid json file %s", path)
 	}
 
-	for _, entity := range allEntities {
+	for i, entry := range entries {
+		entity, err := prefabs.Expand(entry)
+		if err != nil {
+			return errors.Wrapf(err, "invalid entity %d in %s", i, path)
+		}
+
 		l.Set(entity)
 	}
 
 	return nil
 }
 
+// ToJSONFile writes a snapshot of every entity to the file at path, in the
+// format read by FromJSONFile. The snapshot is written to a temporary file
+// in the same directory and renamed over path, so readers never observe a
+// partially written file.
+func (l *Locker) ToJSONFile(path string) error {
+	allEntities := l.All()
+	sort.Slice(allEntities, func(i, j int) bool {
+		return allEntities[i].ID.String() < allEntities[j].ID.String()
+	})
+
+	bytes, err := json.Marshal(allEntities)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal entities")
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.Wrapf(err, "could not create snapshot for %s", path)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(bytes); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "could not write snapshot %s", tmp.Name())
+	}
+
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "could not sync snapshot %s", tmp.Name())
+	}
+
+	if err = tmp.Close(); err != nil {
+		return errors.Wrapf(err, "could not close snapshot %s", tmp.Name())
+	}
+
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return errors.Wrapf(err, "could not chmod snapshot %s", tmp.Name())
+	}
+
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return errors.Wrapf(err, "could not replace %s", path)
+	}
+
+	return nil
+}
+
 func MakeLocker() Locker {
-	ids := makeIDContainer()
-	pos := makePosContainer()
 	return Locker{
-		byID:  &ids,
-		byPos: &pos,
+		mux:   new(sync.RWMutex),
+		byID:  make(idContainer),
+		byPos: make(posContainer),
 	}
 }
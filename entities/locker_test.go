@@ -0,0 +1,272 @@
+package entities
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/clagraff/devoid/components"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	gridSize   = 4
+	iterations = 500
+)
+
+// errRollback is returned from transactions which should be rolled back.
+var errRollback = errors.New("rollback")
+
+// randomPosition returns a position on a small grid, so that entities
+// frequently share positions.
+func randomPosition(rng *rand.Rand) components.Position {
+	return components.Position{X: rng.Intn(gridSize), Y: rng.Intn(gridSize)}
+}
+
+func makeEntity(id uuid.UUID, pos components.Position) Entity {
+	return Entity{
+		ID:         id,
+		Components: components.MakeSet(pos, components.Spatial{Stackable: true}),
+	}
+}
+
+// checkIndexes reports the first way in which the locker's position index
+// disagrees with its entities.
+func checkIndexes(l *Locker) error {
+	l.mux.RLock()
+	defer l.mux.RUnlock()
+
+	seen := make(map[uuid.UUID]components.Position)
+	for pos, ids := range l.byPos {
+		if len(ids) == 0 {
+			return errors.Errorf("empty index entry at %+v", pos)
+		}
+
+		for id := range ids {
+			if other, ok := seen[id]; ok {
+				return errors.Errorf("%s indexed at both %+v and %+v", id, other, pos)
+			}
+			seen[id] = pos
+
+			entity, ok := l.byID[id]
+			if !ok {
+				return errors.Errorf("deleted entity %s indexed at %+v", id, pos)
+			}
+
+			if current, ok := entity.Position(); !ok || current != pos {
+				return errors.Errorf("%s indexed at %+v but is at %+v", id, pos, current)
+			}
+		}
+	}
+
+	for id, entity := range l.byID {
+		pos, ok := entity.Position()
+		if !ok {
+			continue
+		}
+
+		if indexed, ok := seen[id]; !ok || indexed != pos {
+			return errors.Errorf("%s at %+v is not indexed there", id, pos)
+		}
+	}
+
+	return nil
+}
+
+// countPositions counts how many positions each entity is found at, seen
+// through the provided store.
+func countPositions(store Store) map[uuid.UUID]int {
+	counts := make(map[uuid.UUID]int)
+	for x := 0; x < gridSize; x++ {
+		for y := 0; y < gridSize; y++ {
+			found, err := store.GetByPosition(components.Position{X: x, Y: y})
+			if err != nil {
+				continue
+			}
+
+			for _, entity := range found {
+				counts[entity.ID]++
+			}
+		}
+	}
+
+	return counts
+}
+
+func TestLockerConcurrentAccess(t *testing.T) {
+	locker := MakeLocker()
+
+	// Fixed entities are moved but never deleted, so they must always be
+	// found at exactly one position.
+	fixed := make([]uuid.UUID, 8)
+	for i := range fixed {
+		fixed[i] = uuid.Must(uuid.NewV4())
+		locker.Set(makeEntity(fixed[i], components.Position{}))
+	}
+
+	wg := new(sync.WaitGroup)
+	run := func(seed int64, fn func(*rand.Rand)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn(rand.New(rand.NewSource(seed)))
+		}()
+	}
+
+	for i := 0; i < 4; i++ {
+		run(int64(i), func(rng *rand.Rand) {
+			for n := 0; n < iterations; n++ {
+				id := fixed[rng.Intn(len(fixed))]
+				locker.Set(makeEntity(id, randomPosition(rng)))
+			}
+		})
+
+		run(int64(10+i), func(rng *rand.Rand) {
+			for n := 0; n < iterations; n++ {
+				id := uuid.Must(uuid.NewV4())
+				locker.Set(makeEntity(id, randomPosition(rng)))
+				locker.Set(makeEntity(id, randomPosition(rng)))
+				if err := locker.Delete(id); err != nil {
+					t.Errorf("could not delete %s: %v", id, err)
+					return
+				}
+			}
+		})
+
+		run(int64(20+i), func(rng *rand.Rand) {
+			for n := 0; n < iterations; n++ {
+				pos := randomPosition(rng)
+				found, err := locker.GetByPosition(pos)
+				if err != nil {
+					continue
+				}
+
+				for _, entity := range found {
+					if current, ok := entity.Position(); !ok || current != pos {
+						t.Errorf("%s found at %+v but is at %+v", entity.ID, pos, current)
+						return
+					}
+				}
+			}
+		})
+
+		run(int64(30+i), func(rng *rand.Rand) {
+			for n := 0; n < iterations; n++ {
+				rollback := rng.Intn(2) == 0
+				err := locker.Transaction(func(tx *Tx) error {
+					for id, count := range countPositions(tx) {
+						if count != 1 {
+							return errors.Errorf("%s found at %d positions", id, count)
+						}
+					}
+
+					for _, id := range fixed {
+						if _, err := tx.GetByID(id); err != nil {
+							return err
+						}
+					}
+
+					for i := 0; i < 3; i++ {
+						id := fixed[rng.Intn(len(fixed))]
+						tx.Set(makeEntity(id, randomPosition(rng)))
+					}
+
+					tx.Set(makeEntity(uuid.Must(uuid.NewV4()), randomPosition(rng)))
+
+					if rollback {
+						return errRollback
+					}
+					return nil
+				})
+
+				if err != nil && err != errRollback {
+					t.Error(err)
+					return
+				}
+
+				if err := checkIndexes(&locker); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		})
+	}
+
+	wg.Wait()
+
+	if err := checkIndexes(&locker); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := countPositions(&locker)
+	for _, id := range fixed {
+		if counts[id] != 1 {
+			t.Errorf("%s found at %d positions", id, counts[id])
+		}
+	}
+}
+
+func TestTransactionRollbackRestoresIndexes(t *testing.T) {
+	locker := MakeLocker()
+
+	moved := uuid.Must(uuid.NewV4())
+	deleted := uuid.Must(uuid.NewV4())
+	locker.Set(makeEntity(moved, components.Position{X: 1, Y: 1}))
+	locker.Set(makeEntity(deleted, components.Position{X: 2, Y: 2}))
+
+	added := uuid.Must(uuid.NewV4())
+	err := locker.Transaction(func(tx *Tx) error {
+		tx.Set(makeEntity(moved, components.Position{X: 3, Y: 3}))
+		tx.Delete(deleted)
+		tx.Set(makeEntity(added, components.Position{X: 1, Y: 1}))
+		return errRollback
+	})
+	if err != errRollback {
+		t.Fatalf("expected the rollback error, got %v", err)
+	}
+
+	if err := checkIndexes(&locker); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := locker.GetByID(added); err == nil {
+		t.Errorf("entity added by a rolled back transaction still exists")
+	}
+
+	expected := map[uuid.UUID]components.Position{
+		moved:   {X: 1, Y: 1},
+		deleted: {X: 2, Y: 2},
+	}
+	for id, pos := range expected {
+		found, err := locker.GetByPosition(pos)
+		if err != nil || len(found) != 1 || found[0].ID != id {
+			t.Errorf("expected only %s at %+v, found %v (%v)", id, pos, found, err)
+		}
+	}
+}
+
+func TestTransactionFailedOperationRollsBack(t *testing.T) {
+	locker := MakeLocker()
+
+	id := uuid.Must(uuid.NewV4())
+	locker.Set(makeEntity(id, components.Position{}))
+
+	err := locker.Transaction(func(tx *Tx) error {
+		tx.Set(makeEntity(id, components.Position{X: 1}))
+		tx.Delete(uuid.Must(uuid.NewV4()))
+		return nil
+	})
+	if err == nil {
+		t.Fatal("expected deleting a missing entity to fail the transaction")
+	}
+
+	if err := checkIndexes(&locker); err != nil {
+		t.Fatal(err)
+	}
+
+	entity, _ := locker.GetByID(id)
+	if pos, _ := entity.Position(); pos != (components.Position{}) {
+		t.Errorf("expected %s back at the origin, found it at %+v", id, pos)
+	}
+}
@@ -0,0 +1,119 @@
+package entities
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"unicode/utf8"
+
+	"github.com/clagraff/devoid/components"
+	"github.com/pkg/errors"
+)
+
+// Legend maps the characters of a map file to world file entries, which are
+// expanded at every cell holding that character. Characters mapped to null
+// create nothing.
+type Legend map[rune]json.RawMessage
+
+// DefaultLegend is used for map files loaded without a legend.
+func DefaultLegend() Legend {
+	return Legend{
+		'#': json.RawMessage(`{"Spatial":{"Stackable":false}}`),
+		'+': json.RawMessage(`{"Spatial":{"Stackable":false,"Toggleable":true}}`),
+		'.': nil,
+		' ': nil,
+		'@': json.RawMessage(`{"Spawn":{},"Spatial":{"Stackable":true}}`),
+	}
+}
+
+// LoadLegend reads a JSON object mapping single characters to world file
+// entries, or to null.
+func LoadLegend(path string) (Legend, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not find json file %s", path)
+	}
+
+	entries := make(map[string]json.RawMessage)
+	if err = json.Unmarshal(bytes, &entries); err != nil {
+		return nil, errors.Wrapf(err, "not a valid json file %s", path)
+	}
+
+	legend := make(Legend, len(entries))
+	for key, entry := range entries {
+		if utf8.RuneCountInString(key) != 1 {
+			return nil, errors.Errorf("legend key %q in %s is not a single character", key, path)
+		}
+
+		ch, _ := utf8.DecodeRuneInString(key)
+		if string(entry) == "null" {
+			entry = nil
+		}
+		legend[ch] = entry
+	}
+
+	return legend, nil
+}
+
+// FromMapFile builds entities from a text map, where each character is a
+// cell at the Position of its column and line. Every cell is expanded from
+// its legend entry, which may reference the provided prefabs, and is given
+// a new ID.
+func (l *Locker) FromMapFile(path string, legend Legend, prefabs Prefabs) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "could not find map file %s", path)
+	}
+	defer file.Close()
+
+	built := make([]Entity, 0)
+	scanner := bufio.NewScanner(file)
+
+	for y := 0; scanner.Scan(); y++ {
+		x := 0
+		for _, ch := range scanner.Text() {
+			entry, ok := legend[ch]
+			if !ok {
+				return errors.Errorf("%s:%d:%d: no legend entry for %q", path, y+1, x+1, ch)
+			}
+
+			if entry != nil {
+				entity, err := prefabs.expandCell(entry)
+				if err != nil {
+					return errors.Wrapf(err, "%s:%d:%d: invalid legend entry for %q", path, y+1, x+1, ch)
+				}
+
+				entity.Attach(components.Position{X: x, Y: y})
+				built = append(built, entity)
+			}
+
+			x++
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return errors.Wrapf(err, "could not read map file %s", path)
+	}
+
+	for _, entity := range built {
+		l.Set(entity)
+	}
+
+	return nil
+}
+
+// expandCell expands a legend entry, which must not fix an ID since it is
+// shared by every cell holding its character.
+func (prefabs Prefabs) expandCell(entry json.RawMessage) (Entity, error) {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(entry, &fields); err != nil {
+		return Entity{}, errors.Wrap(err, "legend entry is not an object")
+	}
+
+	if _, ok := fields["ID"]; ok {
+		return Entity{}, errors.New("legend entries may not set an ID")
+	}
+
+	return prefabs.Expand(entry)
+}
@@ -0,0 +1,92 @@
+package entities
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/clagraff/devoid/components"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Prefabs are named sets of components which entries in a world file may
+// reference by name, instead of spelling every component out in full.
+type Prefabs map[string]components.Set
+
+// LoadPrefabs reads a JSON object mapping prefab names to components.
+func LoadPrefabs(path string) (Prefabs, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not find json file %s", path)
+	}
+
+	prefabs := make(Prefabs)
+	if err = json.Unmarshal(bytes, &prefabs); err != nil {
+		return nil, errors.Wrapf(err, "not a valid json file %s", path)
+	}
+
+	return prefabs, nil
+}
+
+// Expand builds an entity from a world file entry. An entry may name a
+// "Prefab" whose components it starts from; any components in the entry
+// override the prefab's field by field. Entries without an ID are given a
+// new one.
+func (prefabs Prefabs) Expand(raw json.RawMessage) (Entity, error) {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return Entity{}, errors.Wrap(err, "entity entry is not an object")
+	}
+
+	entity := Entity{}
+
+	if rawPrefab, ok := fields["Prefab"]; ok {
+		var name string
+		if err := json.Unmarshal(rawPrefab, &name); err != nil {
+			return Entity{}, errors.Wrap(err, "invalid prefab name")
+		}
+
+		prefab, ok := prefabs[name]
+		if !ok {
+			return Entity{}, errors.Errorf("unknown prefab %s", name)
+		}
+
+		entity.Components = prefab
+		delete(fields, "Prefab")
+	}
+
+	if rawID, ok := fields["ID"]; ok {
+		if err := json.Unmarshal(rawID, &entity.ID); err != nil {
+			return Entity{}, errors.Wrap(err, "invalid entity ID")
+		}
+		delete(fields, "ID")
+	} else {
+		entity.ID = uuid.Must(uuid.NewV4())
+	}
+
+	if rawVersion, ok := fields["Version"]; ok {
+		if err := json.Unmarshal(rawVersion, &entity.Version); err != nil {
+			return Entity{}, errors.Wrapf(err, "invalid version for entity %s", entity.ID)
+		}
+		delete(fields, "Version")
+	}
+
+	for name, rawComponent := range fields {
+		var component components.Component
+		var err error
+
+		if base, ok := entity.Components.Lookup(name); ok {
+			component, err = components.Override(base, rawComponent)
+		} else {
+			component, err = components.Decode(name, rawComponent)
+		}
+
+		if err != nil {
+			return Entity{}, errors.Wrapf(err, "invalid entity %s", entity.ID)
+		}
+
+		entity.Attach(component)
+	}
+
+	return entity, nil
+}
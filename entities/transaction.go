@@ -0,0 +1,182 @@
+package entities
+
+import (
+	"github.com/clagraff/devoid/components"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Store is the set of entity operations offered by both a Locker and a Tx.
+type Store interface {
+	All() []Entity
+	GetByID(uuid.UUID) (Entity, error)
+	GetByPosition(components.Position) ([]Entity, error)
+	Query(...components.Component) []Entity
+
+	Set(Entity) error
+	CompareAndSet(Entity) error
+	Update(uuid.UUID, func(*Entity) error) error
+	Delete(uuid.UUID) error
+	DeleteFromPos(uuid.UUID, components.Position) error
+	DeleteAll()
+}
+
+// original is the state of an entity before a Tx first modified it.
+type original struct {
+	entity  Entity
+	existed bool
+}
+
+// posEntry is a position index entry removed by a Tx.
+type posEntry struct {
+	pos components.Position
+	id  uuid.UUID
+}
+
+// Tx is a Store whose modifications are applied all-or-nothing by
+// Locker.Transaction. A Tx must not be used after its transaction returns.
+type Tx struct {
+	locker *Locker
+
+	originals  map[uuid.UUID]original
+	removedPos []posEntry
+
+	// err is the first error returned by a modifying operation, other
+	// than a version conflict.
+	err error
+}
+
+// Transaction runs fn with exclusive access to the locker. If fn returns an
+// error, a modifying operation on the Tx fails for any reason other than a
+// version conflict, or fn panics, every change made through the Tx is
+// rolled back. The Locker itself must not be used
+// from within fn.
+func (l *Locker) Transaction(fn func(*Tx) error) (err error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	tx := &Tx{
+		locker:     l,
+		originals:  make(map[uuid.UUID]original),
+		removedPos: make([]posEntry, 0),
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			tx.rollback()
+			panic(r)
+		}
+	}()
+
+	err = fn(tx)
+	if err == nil {
+		err = tx.err
+	}
+
+	if err != nil {
+		tx.rollback()
+	}
+
+	return err
+}
+
+func (tx *Tx) All() []Entity {
+	return tx.locker.byID.All()
+}
+
+func (tx *Tx) GetByID(id uuid.UUID) (Entity, error) {
+	return tx.locker.get(id)
+}
+
+func (tx *Tx) GetByPosition(pos components.Position) ([]Entity, error) {
+	return tx.locker.getByPosition(pos)
+}
+
+func (tx *Tx) Query(prototypes ...components.Component) []Entity {
+	return tx.locker.byID.Query(prototypes...)
+}
+
+func (tx *Tx) Set(entity Entity) error {
+	tx.remember(entity.ID)
+	tx.locker.set(entity)
+	return nil
+}
+
+func (tx *Tx) CompareAndSet(entity Entity) error {
+	tx.remember(entity.ID)
+	return tx.fail(tx.locker.compareAndSet(entity))
+}
+
+func (tx *Tx) Update(id uuid.UUID, fn func(*Entity) error) error {
+	tx.remember(id)
+	return tx.fail(tx.locker.update(id, fn))
+}
+
+func (tx *Tx) Delete(id uuid.UUID) error {
+	tx.remember(id)
+	return tx.fail(tx.locker.delete(id))
+}
+
+func (tx *Tx) DeleteFromPos(id uuid.UUID, pos components.Position) error {
+	if _, ok := tx.locker.byPos[pos][id]; ok {
+		entity, ok := tx.locker.byID[id]
+		if current, hasPos := entity.Position(); !ok || !hasPos || current != pos {
+			tx.removedPos = append(tx.removedPos, posEntry{pos: pos, id: id})
+		}
+	}
+
+	return tx.fail(tx.locker.deleteFromPos(id, pos))
+}
+
+func (tx *Tx) DeleteAll() {
+	for id := range tx.locker.byID {
+		tx.remember(id)
+	}
+
+	tx.locker.deleteAll()
+}
+
+// remember records the state of the entity with the provided id, the first
+// time it is about to be modified.
+func (tx *Tx) remember(id uuid.UUID) {
+	if _, ok := tx.originals[id]; ok {
+		return
+	}
+
+	entity, ok := tx.locker.byID[id]
+	tx.originals[id] = original{entity: entity, existed: ok}
+}
+
+// fail records err as the transaction's failure, if it is the first.
+// Version conflicts are left for the caller to rebase or give up on.
+func (tx *Tx) fail(err error) error {
+	if err != nil && tx.err == nil && !IsVersionConflict(err) {
+		tx.err = err
+	}
+
+	return err
+}
+
+// rollback restores every entity and index entry the Tx modified.
+func (tx *Tx) rollback() {
+	l := tx.locker
+
+	for id, orig := range tx.originals {
+		if current, ok := l.byID[id]; ok {
+			if pos, ok := current.Position(); ok {
+				l.byPos.Remove(pos, id)
+			}
+			delete(l.byID, id)
+		}
+
+		if orig.existed {
+			l.byID[id] = orig.entity
+			if pos, ok := orig.entity.Position(); ok {
+				l.byPos.Add(pos, id)
+			}
+		}
+	}
+
+	for _, entry := range tx.removedPos {
+		l.byPos.Add(entry.pos, entry.id)
+	}
+}
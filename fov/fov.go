@@ -0,0 +1,113 @@
+// Package fov computes which positions are visible from a point, using
+// recursive shadowcasting.
+package fov
+
+import (
+	"github.com/clagraff/devoid/components"
+)
+
+// octants holds the xx, xy, yx and yy multipliers which transform
+// coordinates in the first octant into each of the eight octants.
+var octants = [8][4]int{
+	{1, 0, 0, 1},
+	{0, 1, 1, 0},
+	{0, -1, 1, 0},
+	{-1, 0, 0, 1},
+	{-1, 0, 0, -1},
+	{0, -1, -1, 0},
+	{0, 1, -1, 0},
+	{1, 0, 0, -1},
+}
+
+// Compute returns the set of positions within radius of origin which can be
+// seen from origin. Positions for which opaque returns true block sight of
+// whatever lies behind them, but are themselves visible.
+func Compute(origin components.Position, radius int, opaque func(components.Position) bool) map[components.Position]bool {
+	visible := map[components.Position]bool{origin: true}
+
+	if radius <= 0 {
+		return visible
+	}
+
+	for _, m := range octants {
+		s := shadowcaster{
+			origin:  origin,
+			radius:  radius,
+			opaque:  opaque,
+			visible: visible,
+			xx:      m[0],
+			xy:      m[1],
+			yx:      m[2],
+			yy:      m[3],
+		}
+		s.cast(1, 1.0, 0.0)
+	}
+
+	return visible
+}
+
+// shadowcaster scans a single octant.
+type shadowcaster struct {
+	origin  components.Position
+	radius  int
+	opaque  func(components.Position) bool
+	visible map[components.Position]bool
+
+	xx, xy, yx, yy int
+}
+
+// cast scans rows outward from row, between the start and end slopes,
+// recursing past each run of opaque cells with a narrowed slope range.
+func (s shadowcaster) cast(row int, start, end float64) {
+	if start < end {
+		return
+	}
+
+	radiusSquared := s.radius * s.radius
+	nextStart := start
+
+	for j := row; j <= s.radius; j++ {
+		dy := -j
+		blocked := false
+
+		for dx := -j; dx <= 0; dx++ {
+			pos := components.Position{
+				X: s.origin.X + dx*s.xx + dy*s.xy,
+				Y: s.origin.Y + dx*s.yx + dy*s.yy,
+			}
+
+			leftSlope := (float64(dx) - 0.5) / (float64(dy) + 0.5)
+			rightSlope := (float64(dx) + 0.5) / (float64(dy) - 0.5)
+
+			if start < rightSlope {
+				continue
+			}
+			if end > leftSlope {
+				break
+			}
+
+			if dx*dx+dy*dy <= radiusSquared {
+				s.visible[pos] = true
+			}
+
+			isOpaque := s.opaque(pos)
+			if blocked {
+				if isOpaque {
+					nextStart = rightSlope
+					continue
+				}
+
+				blocked = false
+				start = nextStart
+			} else if isOpaque && j < s.radius {
+				blocked = true
+				s.cast(j+1, start, leftSlope)
+				nextStart = rightSlope
+			}
+		}
+
+		if blocked {
+			break
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package network
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/clagraff/devoid/wire"
+
+	errs "github.com/go-errors/errors"
+)
+
+// Codec encodes the messages sent over a tunnel, along with their contents.
+// The codec a tunnel uses is agreed on during the handshake.
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, ptr interface{}) error
+}
+
+type jsonCodec struct{}
+
+func (_ jsonCodec) Name() string {
+	return "json"
+}
+
+func (_ jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (_ jsonCodec) Unmarshal(data []byte, ptr interface{}) error {
+	return json.Unmarshal(data, ptr)
+}
+
+type binaryCodec struct{}
+
+func (_ binaryCodec) Name() string {
+	return "binary"
+}
+
+func (_ binaryCodec) Marshal(v interface{}) ([]byte, error) {
+	return wire.Marshal(v)
+}
+
+func (_ binaryCodec) Unmarshal(data []byte, ptr interface{}) error {
+	return wire.Unmarshal(data, ptr)
+}
+
+var (
+	// JSON encodes messages as JSON. It is used when a client does not
+	// name any codecs during the handshake.
+	JSON Codec = jsonCodec{}
+
+	// Binary encodes messages in the compact wire format.
+	Binary Codec = binaryCodec{}
+)
+
+// Codecs returns the codecs this build supports, most preferred first.
+func Codecs() []Codec {
+	return []Codec{Binary, JSON}
+}
+
+func codecNames(codecs []Codec) []string {
+	names := make([]string, 0, len(codecs))
+	for _, codec := range codecs {
+		names = append(names, codec.Name())
+	}
+	return names
+}
+
+func codecByName(name string) (Codec, bool) {
+	for _, codec := range Codecs() {
+		if codec.Name() == name {
+			return codec, true
+		}
+	}
+	return nil, false
+}
+
+// negotiateCodec returns the first of the client's preferred codecs which
+// is supported, or JSON if the client named none.
+func negotiateCodec(preferred []string) (Codec, error) {
+	if len(preferred) == 0 {
+		return JSON, nil
+	}
+
+	for _, name := range preferred {
+		if codec, ok := codecByName(name); ok {
+			return codec, nil
+		}
+	}
+
+	return nil, errs.Errorf(
+		"no supported codec among %s; supported codecs are %s",
+		strings.Join(preferred, ", "),
+		strings.Join(codecNames(Codecs()), ", "),
+	)
+}
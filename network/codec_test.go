@@ -0,0 +1,112 @@
+package network_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/clagraff/devoid/actions"
+	"github.com/clagraff/devoid/components"
+	"github.com/clagraff/devoid/entities"
+	"github.com/clagraff/devoid/network"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// perceiveSize is about how many entities a full Perceive sends a client
+// with a Vision radius of 8 standing in an open room.
+const perceiveSize = 200
+
+// perceivePayload returns the actions sent for a full Perceive of n
+// entities, each of which is sent in its own message.
+func perceivePayload(n int) []actions.SetEntity {
+	payload := make([]actions.SetEntity, n)
+	for i := range payload {
+		payload[i] = actions.SetEntity{
+			Entity: entities.Entity{
+				ID:      uuid.Must(uuid.NewV4()),
+				Version: uint64(i + 1),
+				Components: components.MakeSet(
+					components.Position{X: i % 17, Y: i / 17},
+					components.Spatial{Stackable: i%5 != 0, Toggleable: i%7 == 0},
+				),
+			},
+		}
+	}
+
+	return payload
+}
+
+func TestCodecsRoundTripPerceive(t *testing.T) {
+	payload := perceivePayload(perceiveSize)
+
+	for _, codec := range network.Codecs() {
+		tunnel := network.Tunnel{Codec: codec}
+
+		for _, action := range payload {
+			message, err := tunnel.MakeMessage("set-entity", action)
+			if err != nil {
+				t.Fatalf("%s: %v", codec.Name(), err)
+			}
+
+			var decoded actions.SetEntity
+			if err := message.Decode(&decoded); err != nil {
+				t.Fatalf("%s: %v", codec.Name(), err)
+			}
+
+			if !reflect.DeepEqual(decoded, action) {
+				t.Fatalf("%s: expected %+v, got %+v", codec.Name(), action, decoded)
+			}
+		}
+	}
+}
+
+// BenchmarkCodecs compares the codecs on the messages of a full Perceive,
+// reporting the total encoded size of the payload.
+func BenchmarkCodecs(b *testing.B) {
+	payload := perceivePayload(perceiveSize)
+
+	for _, codec := range network.Codecs() {
+		encoded := make([][]byte, len(payload))
+		size := 0
+		for i, action := range payload {
+			data, err := codec.Marshal(action)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			encoded[i] = data
+			size += len(data)
+		}
+
+		b.Run(codec.Name()+"/marshal", func(b *testing.B) {
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+
+			for n := 0; n < b.N; n++ {
+				for _, action := range payload {
+					if _, err := codec.Marshal(action); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+
+			b.ReportMetric(float64(size), "bytes/perceive")
+		})
+
+		b.Run(codec.Name()+"/unmarshal", func(b *testing.B) {
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+
+			for n := 0; n < b.N; n++ {
+				for _, data := range encoded {
+					var action actions.SetEntity
+					if err := codec.Unmarshal(data, &action); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+
+			b.ReportMetric(float64(size), "bytes/perceive")
+		})
+	}
+}
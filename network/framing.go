@@ -0,0 +1,82 @@
+package network
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+
+	errs "github.com/go-errors/errors"
+)
+
+// frameHeaderSize is the length, in bytes, of the big-endian payload length
+// which prefixes every frame.
+const frameHeaderSize = 4
+
+// maxFrameSize bounds the payload of a single frame. A peer sending a larger
+// frame has its connection closed.
+const maxFrameSize = 1 << 20
+
+// writeFrame writes payload to w, prefixed with its length.
+func writeFrame(w io.Writer, payload []byte) error {
+	if len(payload) > maxFrameSize {
+		return errs.Errorf("frame of %d bytes exceeds the %d byte limit", len(payload), maxFrameSize)
+	}
+
+	frame := make([]byte, frameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[frameHeaderSize:], payload)
+
+	if _, err := w.Write(frame); err != nil {
+		return errs.New(err)
+	}
+
+	return nil
+}
+
+// readFrame reads the payload of the next frame from r. An io.EOF is
+// returned unwrapped if r ends cleanly between frames.
+func readFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, errs.New(err)
+	}
+
+	size := binary.BigEndian.Uint32(header)
+	if size > maxFrameSize {
+		return nil, errs.Errorf("frame of %d bytes exceeds the %d byte limit", size, maxFrameSize)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, errs.New(err)
+	}
+
+	return payload, nil
+}
+
+// writeJSON writes i to w as a single JSON frame.
+func writeJSON(w io.Writer, i interface{}) error {
+	payload, err := json.Marshal(i)
+	if err != nil {
+		return errs.New(err)
+	}
+
+	return writeFrame(w, payload)
+}
+
+// readJSON reads the next frame from r and decodes it into ptr.
+func readJSON(r io.Reader, ptr interface{}) error {
+	payload, err := readFrame(r)
+	if err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal(payload, ptr); err != nil {
+		return errs.New(err)
+	}
+
+	return nil
+}
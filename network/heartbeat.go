@@ -0,0 +1,172 @@
+package network
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	errs "github.com/go-errors/errors"
+)
+
+// Once the handshake is complete, the first byte of every frame's payload
+// says what the rest of the payload holds.
+const (
+	frameMessage byte = iota
+	framePing
+	framePong
+)
+
+// DefaultHeartbeat is the interval at which peers ping each other when the
+// server does not specify one.
+const DefaultHeartbeat = 5 * time.Second
+
+// missedHeartbeats is how many heartbeat intervals may pass without any
+// frame arriving from a peer before its connection is considered dead.
+const missedHeartbeats = 3
+
+// Latency holds the most recently measured round-trip time of a tunnel's
+// connection. It is safe for concurrent use.
+type Latency struct {
+	nanos int64
+}
+
+// RTT returns the most recently measured round-trip time, or zero if no
+// heartbeat has been answered yet.
+func (latency *Latency) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&latency.nanos))
+}
+
+func (latency *Latency) set(rtt time.Duration) {
+	atomic.StoreInt64(&latency.nanos, int64(rtt))
+}
+
+// link carries a tunnel's frames over its connection once the handshake is
+// complete, shared by the connection's sending and receiving goroutines.
+type link struct {
+	conn      net.Conn
+	tunnel    Tunnel
+	heartbeat time.Duration
+
+	// pongs holds the payloads of pings the sender has yet to answer.
+	pongs chan []byte
+
+	// done is closed once the sender stops, after which nothing reads the
+	// tunnel's Incoming channel for certain.
+	done chan struct{}
+}
+
+func newLink(conn net.Conn, tunnel Tunnel, heartbeat time.Duration) link {
+	if heartbeat <= 0 {
+		heartbeat = DefaultHeartbeat
+	}
+
+	return link{
+		conn:      conn,
+		tunnel:    tunnel,
+		heartbeat: heartbeat,
+		pongs:     make(chan []byte, missedHeartbeats),
+		done:      make(chan struct{}),
+	}
+}
+
+// timeout is how long a peer may go without being heard from.
+func (l link) timeout() time.Duration {
+	return l.heartbeat * missedHeartbeats
+}
+
+func (l link) write(kind byte, payload []byte) error {
+	l.conn.SetWriteDeadline(time.Now().Add(l.timeout()))
+	return writeFrame(l.conn, append([]byte{kind}, payload...))
+}
+
+// send writes the tunnel's outgoing messages, answers pings, and pings the
+// peer every heartbeat until Outgoing is closed or a write fails.
+func (l link) send() error {
+	defer close(l.done)
+
+	ticker := time.NewTicker(l.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case message, ok := <-l.tunnel.Outgoing:
+			if !ok {
+				return nil
+			}
+
+			payload, err := l.tunnel.Codec.Marshal(message)
+			if err != nil {
+				return errs.New(err)
+			}
+
+			if err = l.write(frameMessage, payload); err != nil {
+				return err
+			}
+		case payload := <-l.pongs:
+			if err := l.write(framePong, payload); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			sent := make([]byte, 8)
+			binary.BigEndian.PutUint64(sent, uint64(time.Now().UnixNano()))
+
+			if err := l.write(framePing, sent); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// receive reads frames until the connection ends, a frame is invalid, the
+// peer is silent for missedHeartbeats intervals, or the sender stops.
+// Messages are passed to Incoming, pings are answered, and pongs update the
+// tunnel's Latency.
+func (l link) receive(buff *bufio.Reader) error {
+	for {
+		l.conn.SetReadDeadline(time.Now().Add(l.timeout()))
+
+		payload, err := readFrame(buff)
+		if err != nil {
+			return err
+		}
+
+		if len(payload) == 0 {
+			return errs.New("empty frame")
+		}
+
+		switch payload[0] {
+		case frameMessage:
+			message := Message{codec: l.tunnel.Codec}
+			if err = l.tunnel.Codec.Unmarshal(payload[1:], &message); err != nil {
+				return errs.New(err)
+			}
+
+			// Once the tunnel's owner has closed Outgoing it may no longer
+			// read Incoming, so the connection is treated as ended.
+			select {
+			case l.tunnel.Incoming <- message:
+			case <-l.done:
+				return io.EOF
+			}
+		case framePing:
+			// A peer pinging faster than it reads its pongs is not
+			// answered every time.
+			select {
+			case l.pongs <- payload[1:]:
+			default:
+			}
+		case framePong:
+			if len(payload) != 9 {
+				return errs.Errorf("invalid pong of %d bytes", len(payload))
+			}
+
+			sent := int64(binary.BigEndian.Uint64(payload[1:]))
+			l.tunnel.Latency.set(time.Duration(time.Now().UnixNano() - sent))
+		default:
+			return errs.Errorf("unknown frame kind %d", payload[0])
+		}
+	}
+}
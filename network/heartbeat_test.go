@@ -0,0 +1,68 @@
+package network
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestReceiveStopsOnceSenderStops checks that a peer which keeps sending
+// after the tunnel's owner has stopped reading Incoming cannot park the
+// receiving goroutine forever.
+func TestReceiveStopsOnceSenderStops(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+
+	tunnel := Tunnel{
+		Codec:    JSON,
+		Latency:  new(Latency),
+		Incoming: make(chan Message, 1),
+		Outgoing: make(chan Message),
+		Closed:   make(chan struct{}, 1),
+	}
+	l := newLink(conn, tunnel, time.Minute)
+
+	received := make(chan error, 1)
+	go func() {
+		received <- l.receive(bufio.NewReader(conn))
+	}()
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- l.send()
+	}()
+
+	payload, err := JSON.Marshal(Message{ContentType: "move"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for writeFrame(peer, append([]byte{frameMessage}, payload...)) == nil {
+		}
+	}()
+
+	// Wait for Incoming to fill, leaving the receiver blocked on it.
+	for deadline := time.Now().Add(time.Second); len(tunnel.Incoming) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("no message was received")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(tunnel.Outgoing)
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-received:
+		if err != io.EOF {
+			t.Errorf("expected the receiver to stop with EOF, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the receiver is still blocked on a full Incoming")
+	}
+}
@@ -2,24 +2,23 @@ package network
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
-	"reflect"
+	"strings"
+	"sync"
 	"time"
 
 	errs "github.com/go-errors/errors"
 	uuid "github.com/satori/go.uuid"
 )
 
-func delimiter() byte {
-	return '\n'
-}
-
 func MustMarshal(i interface{}) []byte {
 	bytes, err := json.Marshal(i)
 	if err != nil {
@@ -39,38 +38,93 @@ func MakeUUID() uuid.UUID {
 	return uuid.Must(uuid.NewV4())
 }
 
+// RawContent is a message's encoded contents. Under the JSON codec it is
+// embedded as raw JSON rather than as a string.
+type RawContent []byte
+
+func (raw RawContent) MarshalJSON() ([]byte, error) {
+	if raw == nil {
+		return []byte("null"), nil
+	}
+	return raw, nil
+}
+
+func (raw *RawContent) UnmarshalJSON(data []byte) error {
+	*raw = append((*raw)[0:0], data...)
+	return nil
+}
+
 type Message struct {
 	ClientID    uuid.UUID
-	Content     json.RawMessage
+	Content     RawContent
 	ContentType string
+
+	// codec is the codec Content was encoded with.
+	codec Codec
 }
 
 func (message Message) String() string {
-	return `{"Message": ` + string(MustMarshal(message)) + `}`
+	return fmt.Sprintf(
+		"Message{ClientID: %s, ContentType: %s, Content: %d bytes}",
+		message.ClientID,
+		message.ContentType,
+		len(message.Content),
+	)
 }
 
-func MakeMessage(clientID uuid.UUID, contents interface{}) Message {
-	bytes, err := json.Marshal(contents)
-	if err != nil {
-		panic(errs.New(err))
+// Decode unmarshals the message's contents into ptr, using the codec they
+// were encoded with.
+func (message Message) Decode(ptr interface{}) error {
+	codec := message.codec
+	if codec == nil {
+		codec = JSON
 	}
 
-	contentType := reflect.TypeOf(contents).String()
-
-	return Message{
-		ClientID:    clientID,
-		Content:     bytes,
-		ContentType: contentType,
+	if err := codec.Unmarshal(message.Content, ptr); err != nil {
+		return errs.New(err)
 	}
+
+	return nil
 }
 
+// Tunnel is a connection to a single peer. Closing Outgoing flushes any
+// queued messages and then closes the underlying connection.
 type Tunnel struct {
 	ID       uuid.UUID
+	EntityID uuid.UUID
+	Codec    Codec
+	Latency  *Latency
 	Incoming chan Message
 	Outgoing chan Message
 	Closed   chan struct{}
 }
 
+// MakeMessage encodes contents with the tunnel's codec, wrapped in a
+// Message to the tunnel's peer tagged with the wire kind the peer should
+// use to decode it.
+func (tunnel Tunnel) MakeMessage(kind string, contents interface{}) (Message, error) {
+	bytes, err := tunnel.Codec.Marshal(contents)
+	if err != nil {
+		return Message{}, errs.New(err)
+	}
+
+	return Message{
+		ClientID:    tunnel.ID,
+		Content:     bytes,
+		ContentType: kind,
+		codec:       tunnel.Codec,
+	}, nil
+}
+
+// markClosed signals that the tunnel's connection has ended, without
+// blocking if that has already been signalled.
+func (tunnel Tunnel) markClosed() {
+	select {
+	case tunnel.Closed <- struct{}{}:
+	default:
+	}
+}
+
 type ConnInfo struct {
 	host string
 	id   uuid.UUID
@@ -91,17 +145,121 @@ func MakeConnInfo(host string, port int, id uuid.UUID, pemPath, certPath string)
 	}
 }
 
+// Authenticator verifies the credentials presented by a connecting client,
+// returning the ID of the entity the client's tunnel is bound to.
+type Authenticator interface {
+	Authenticate(clientID uuid.UUID, token string) (uuid.UUID, error)
+}
+
+// ProtocolVersion is the version of the protocol spoken over tunnels.
+// Peers speaking different versions refuse each other during the
+// handshake.
+const ProtocolVersion = 2
+
+// Capabilities are the message kinds a peer sends, and those it is able to
+// receive. A client is refused unless it can receive every kind the server
+// sends, and the server can receive every kind the client sends.
+type Capabilities struct {
+	Sends    []string
+	Receives []string
+}
+
+// unsupportedKinds returns the kinds in sent which are not in received.
+func unsupportedKinds(sent, received []string) []string {
+	known := make(map[string]bool, len(received))
+	for _, kind := range received {
+		known[kind] = true
+	}
+
+	unsupported := make([]string, 0)
+	for _, kind := range sent {
+		if !known[kind] {
+			unsupported = append(unsupported, kind)
+		}
+	}
+
+	return unsupported
+}
+
+// RejectedError is returned by a Client when the server refuses its
+// handshake.
+type RejectedError struct {
+	Reason string
+}
+
+func (err RejectedError) Error() string {
+	return "connection rejected by server: " + err.Reason
+}
+
+// IncompatibleError is returned by a Client when the server speaks a
+// protocol version the client does not.
+type IncompatibleError struct {
+	Reason string
+}
+
+func (err IncompatibleError) Error() string {
+	return "incompatible server: " + err.Reason
+}
+
+// hello is sent by a client to open a handshake. Codecs names the codecs
+// the client supports, most preferred first.
+type hello struct {
+	Version  int
+	ClientID uuid.UUID
+	Token    string
+	Codecs   []string
+	Sends    []string
+	Receives []string
+}
+
+// welcome is the server's reply to a hello, naming the codec the tunnel
+// will use and the interval at which both peers send heartbeats. A
+// non-empty Error indicates the handshake was refused.
+type welcome struct {
+	Version   int
+	ServerID  uuid.UUID
+	EntityID  uuid.UUID
+	Codec     string
+	Heartbeat time.Duration
+	Error     string
+}
+
 type Server struct {
 	info ConnInfo
+	auth Authenticator
+	caps Capabilities
+
+	heartbeat time.Duration
+	senders   *sync.WaitGroup
 }
 
-func NewServer(info ConnInfo) *Server {
+// NewServer returns a Server whose tunnels exchange heartbeats at the given
+// interval, or at DefaultHeartbeat if it is not positive.
+func NewServer(info ConnInfo, auth Authenticator, caps Capabilities, heartbeat time.Duration) *Server {
+	if heartbeat <= 0 {
+		heartbeat = DefaultHeartbeat
+	}
+
 	return &Server{
 		info: info,
+		auth: auth,
+		caps: caps,
+
+		heartbeat: heartbeat,
+
+		senders: new(sync.WaitGroup),
 	}
 }
 
-func (server *Server) Serve() (func() error, chan Tunnel, error) {
+// shutdownTimeout bounds how long the close function returned by Serve waits
+// for tunnels to flush their outgoing messages.
+const shutdownTimeout = 5 * time.Second
+
+// Serve accepts connections until ctx is cancelled. The returned function
+// closes any tunnels which were never taken from the channel, and waits for
+// closed tunnels to flush their outgoing messages; it must only be called
+// once the channel is no longer being read.
+func (server *Server) Serve(ctx context.Context) (func() error, chan Tunnel, error) {
 	emptyClose := func() error { return nil }
 	tunnels := make(chan Tunnel, 100)
 
@@ -126,128 +284,229 @@ func (server *Server) Serve() (func() error, chan Tunnel, error) {
 		return emptyClose, tunnels, errs.New(err)
 	}
 
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	accepting := new(sync.WaitGroup)
+	listening := make(chan struct{})
+
 	go func(l net.Listener) {
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				panic(errs.New(err))
-			}
+		defer close(listening)
 
-			clientID, err := server.handshake(conn)
+		for {
+			conn, err := l.Accept()
 			if err != nil {
-				panic(errs.New(err))
+				if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+					return
+				}
+				fmt.Println("error accepting TCP connection", err)
+				continue
 			}
 
-			incoming := make(chan Message, 100)
-			outgoing := make(chan Message, 100)
-			closed := make(chan struct{}, 1)
+			accepting.Add(1)
+			go func() {
+				defer accepting.Done()
+				server.accept(ctx, conn, tunnels)
+			}()
+		}
+	}(listener)
 
-			tunnel := Tunnel{
-				ID:       clientID,
-				Incoming: incoming,
-				Outgoing: outgoing,
-				Closed:   closed,
+	closeFn := func() error {
+		listener.Close()
+
+		flushed := make(chan struct{})
+		go func() {
+			<-listening
+			accepting.Wait()
+
+			for pending := true; pending; {
+				select {
+				case tunnel := <-tunnels:
+					close(tunnel.Outgoing)
+				default:
+					pending = false
+				}
 			}
 
-			tunnels <- tunnel
+			server.senders.Wait()
+			close(flushed)
+		}()
 
-			go server.receive(conn, tunnel)
-			go server.send(conn, tunnel)
+		select {
+		case <-flushed:
+			return nil
+		case <-time.After(shutdownTimeout):
+			return errs.New("timed out waiting for tunnels to flush")
 		}
-	}(listener)
+	}
 
-	return listener.Close, tunnels, nil
+	return closeFn, tunnels, nil
 }
 
-func (s Server) handshake(conn net.Conn) (uuid.UUID, error) {
-	var clientID uuid.UUID
-
+// accept performs the handshake for a newly accepted connection, handing
+// a Tunnel over once the client has been authenticated. Handshakes are cut
+// short once ctx is cancelled, and tunnels completing after that are closed
+// rather than handed over.
+func (server *Server) accept(ctx context.Context, conn net.Conn, tunnels chan Tunnel) {
 	buff := bufio.NewReader(conn)
-	rawID, err := buff.ReadBytes(delimiter())
-	if err != nil {
-		return clientID, errs.New(err)
-	}
 
-	clientID, err = uuid.FromBytes(rawID[:len(rawID)-1])
+	handshaking := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-handshaking:
+		}
+	}()
+
+	request, response, err := server.handshake(conn, buff)
+	close(handshaking)
 	if err != nil {
-		return clientID, errs.New(err)
+		fmt.Println("handshake failed for", conn.RemoteAddr(), err)
+		conn.Close()
+		return
 	}
 
-	if _, err = conn.Write(s.info.id.Bytes()); err != nil {
-		return clientID, errs.New(err)
+	incoming := make(chan Message, 100)
+	outgoing := make(chan Message, 100)
+	closed := make(chan struct{}, 1)
+
+	codec, _ := codecByName(response.Codec)
+
+	tunnel := Tunnel{
+		ID:       request.ClientID,
+		EntityID: response.EntityID,
+		Codec:    codec,
+		Latency:  new(Latency),
+		Incoming: incoming,
+		Outgoing: outgoing,
+		Closed:   closed,
 	}
 
-	if _, err = conn.Write([]byte{delimiter()}); err != nil {
-		return clientID, errs.New(err)
+	l := newLink(conn, tunnel, response.Heartbeat)
+
+	server.senders.Add(1)
+	go server.receive(l, buff)
+	go server.send(l)
+
+	if ctx.Err() != nil {
+		close(outgoing)
+		return
 	}
 
-	return clientID, nil
+	// A tunnel handed over as ctx is cancelled may never be read from the
+	// channel; the close function closes any left behind.
+	select {
+	case tunnels <- tunnel:
+	case <-ctx.Done():
+		close(outgoing)
+	}
 }
 
-func (s Server) receive(conn net.Conn, tunnel Tunnel) {
-	var rawMessage []byte
-	var err error
+// handshake checks the client is compatible, authenticates it, and agrees
+// on the codec the tunnel will use. The handshake itself is always encoded
+// as JSON.
+func (s Server) handshake(conn net.Conn, buff *bufio.Reader) (hello, welcome, error) {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
 
-	buff := bufio.NewReader(conn)
+	request := hello{}
+	response := welcome{
+		Version:  ProtocolVersion,
+		ServerID: s.info.id,
+	}
 
-	for {
-		rawMessage, err = buff.ReadBytes(delimiter())
-		if err != nil {
-			if _, ok := err.(net.Error); ok {
-				break
-			}
-			tunnel.Closed <- struct{}{}
-			if err != io.EOF {
-				panic(err)
-			}
-			return
-		}
-		rawMessage = rawMessage[:len(rawMessage)-1]
+	if err := readJSON(buff, &request); err != nil {
+		return request, response, err
+	}
 
-		message := Message{}
-		err = json.Unmarshal(rawMessage, &message)
-		if err != nil {
-			panic(errs.New(err))
-			tunnel.Closed <- struct{}{}
-		}
+	refuse := func(err error) (hello, welcome, error) {
+		response.Error = err.Error()
+		writeJSON(conn, response)
+		return request, response, errs.New(err)
+	}
+
+	if request.Version != ProtocolVersion {
+		return refuse(errs.Errorf(
+			"client speaks protocol version %d, but the server speaks version %d",
+			request.Version,
+			ProtocolVersion,
+		))
+	}
+
+	if kinds := unsupportedKinds(request.Sends, s.caps.Receives); len(kinds) > 0 {
+		return refuse(errs.Errorf(
+			"client sends messages the server does not support: %s",
+			strings.Join(kinds, ", "),
+		))
+	}
+
+	if kinds := unsupportedKinds(s.caps.Sends, request.Receives); len(kinds) > 0 {
+		return refuse(errs.Errorf(
+			"server sends messages the client does not support: %s",
+			strings.Join(kinds, ", "),
+		))
+	}
+
+	entityID, err := s.auth.Authenticate(request.ClientID, request.Token)
+	if err != nil {
+		return refuse(err)
+	}
+
+	codec, err := negotiateCodec(request.Codecs)
+	if err != nil {
+		return refuse(err)
+	}
 
-		tunnel.Incoming <- message
-		conn.SetDeadline(time.Now().Add(2 * time.Minute))
+	response.EntityID = entityID
+	response.Codec = codec.Name()
+	response.Heartbeat = s.heartbeat
+	if err = writeJSON(conn, response); err != nil {
+		return request, response, err
 	}
+
+	conn.SetDeadline(time.Time{})
+	return request, response, nil
 }
 
-func (s Server) send(conn net.Conn, tunnel Tunnel) {
-	for message := range tunnel.Outgoing {
-		rawMessage, err := json.Marshal(message)
-		if err != nil {
-			tunnel.Closed <- struct{}{}
-			fmt.Println("err mashalling outgoing TCP message", err)
-			return
-		}
+// receive reads from the connection until it ends, fails, or goes silent,
+// after which the connection is closed.
+func (s Server) receive(l link, buff *bufio.Reader) {
+	if err := l.receive(buff); err != io.EOF {
+		fmt.Println("error reading incoming TCP message", err)
+	}
 
-		if _, err = conn.Write(rawMessage); err != nil {
-			tunnel.Closed <- struct{}{}
-			fmt.Println("error writing outgoing TCP message", err)
-			return
-		}
+	l.tunnel.markClosed()
+	l.conn.Close()
+}
 
-		if _, err = conn.Write([]byte{delimiter()}); err != nil {
-			tunnel.Closed <- struct{}{}
-			fmt.Println("err writing TCP message delimiter", err)
-			return
-		}
+func (s Server) send(l link) {
+	defer s.senders.Done()
+	defer l.conn.Close()
 
-		conn.SetDeadline(time.Now().Add(2 * time.Minute))
+	if err := l.send(); err != nil {
+		fmt.Println("error writing outgoing TCP message", err)
+	}
+
+	// Keep draining so writers never block on a dead connection; the
+	// tunnel's owner stops writing once it observes Closed.
+	l.tunnel.markClosed()
+	for range l.tunnel.Outgoing {
 	}
 }
 
 type Client struct {
-	info ConnInfo
+	info  ConnInfo
+	token string
+	caps  Capabilities
 }
 
-func NewClient(info ConnInfo) *Client {
+func NewClient(info ConnInfo, token string, caps Capabilities) *Client {
 	return &Client{
-		info: info,
+		info:  info,
+		token: token,
+		caps:  caps,
 	}
 }
 
@@ -257,6 +516,7 @@ func (client *Client) Dial() (func() error, Tunnel, error) {
 	closed := make(chan struct{}, 1)
 
 	tunnel := Tunnel{
+		Latency:  new(Latency),
 		Incoming: incoming,
 		Outgoing: outgoing,
 		Closed:   closed,
@@ -282,85 +542,89 @@ func (client *Client) Dial() (func() error, Tunnel, error) {
 		return nil, tunnel, errs.New(err)
 	}
 
-	serverID, err := client.handshake(conn)
+	buff := bufio.NewReader(conn)
+
+	response, err := client.handshake(conn, buff)
 	if err != nil {
-		return nil, tunnel, errs.New(err)
+		conn.Close()
+		return nil, tunnel, err
+	}
+
+	codec, ok := codecByName(response.Codec)
+	if !ok {
+		conn.Close()
+		return nil, tunnel, errs.Errorf("server chose unsupported codec %s", response.Codec)
 	}
 
-	tunnel.ID = serverID
+	tunnel.ID = response.ServerID
+	tunnel.EntityID = response.EntityID
+	tunnel.Codec = codec
 
-	go client.send(conn, tunnel)
-	go client.receive(conn, tunnel)
+	l := newLink(conn, tunnel, response.Heartbeat)
+
+	go client.send(l)
+	go client.receive(l, buff)
 	return conn.Close, tunnel, nil
 }
 
-func (client Client) handshake(conn net.Conn) (uuid.UUID, error) {
-	var serverID uuid.UUID
+func (client Client) handshake(conn net.Conn, buff *bufio.Reader) (welcome, error) {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	response := welcome{}
 
-	if _, err := conn.Write(client.info.id.Bytes()); err != nil {
-		return serverID, errs.New(err)
+	request := hello{
+		Version:  ProtocolVersion,
+		ClientID: client.info.id,
+		Token:    client.token,
+		Codecs:   codecNames(Codecs()),
+		Sends:    client.caps.Sends,
+		Receives: client.caps.Receives,
+	}
+	if err := writeJSON(conn, request); err != nil {
+		return response, err
 	}
 
-	if _, err := conn.Write([]byte{delimiter()}); err != nil {
-		return serverID, errs.New(err)
+	if err := readJSON(buff, &response); err != nil {
+		return response, err
 	}
 
-	buff := bufio.NewReader(conn)
-	rawID, err := buff.ReadBytes(delimiter())
-	if err != nil {
-		return serverID, errs.New(err)
+	if response.Error != "" {
+		return response, RejectedError{Reason: response.Error}
 	}
 
-	serverID, err = uuid.FromBytes(rawID[:len(rawID)-1])
-	if err != nil {
-		return serverID, errs.New(err)
+	if response.Version != ProtocolVersion {
+		return response, IncompatibleError{Reason: fmt.Sprintf(
+			"server speaks protocol version %d, but the client speaks version %d",
+			response.Version,
+			ProtocolVersion,
+		)}
 	}
 
-	return serverID, nil
+	return response, nil
 }
 
-func (client Client) send(c net.Conn, tunnel Tunnel) {
-	for message := range tunnel.Outgoing {
-		rawMessage, err := json.Marshal(message)
-		if err != nil {
-			panic(errs.New(err))
-			fmt.Println(errs.New(err))
-			return
-		}
-
-		if _, err = c.Write(rawMessage); err != nil {
-			//panic(errs.New(err))
-			fmt.Println(errs.New(err))
-			return
-		}
+func (client Client) send(l link) {
+	defer l.conn.Close()
 
-		if _, err = c.Write([]byte{delimiter()}); err != nil {
-			//panic(errs.New(err))
-			fmt.Println(errs.New(err))
-			return
-		}
+	if err := l.send(); err != nil {
+		fmt.Println(err)
+	}
 
-		c.SetDeadline(time.Now().Add(2 * time.Minute))
+	// Keep draining so writers never block on a dead connection; the
+	// tunnel's owner stops writing once it observes Closed.
+	l.tunnel.markClosed()
+	for range l.tunnel.Outgoing {
 	}
 }
 
-func (client Client) receive(c net.Conn, tunnel Tunnel) {
-	buff := bufio.NewReader(c)
-	for {
-		rawMessage, err := buff.ReadBytes(delimiter())
-		if err != nil {
-			//panic(errs.New(err))
-			fmt.Println(errs.New(err))
-			return
-		}
-		c.SetDeadline(time.Now().Add(2 * time.Minute))
-		rawMessage = rawMessage[:len(rawMessage)-1]
-
-		message := Message{}
-		if err = json.Unmarshal(rawMessage, &message); err != nil {
-			panic(errs.New(err))
-		}
-
-		tunnel.Incoming <- message
+// receive reads from the connection until it ends, fails, or goes silent,
+// after which the connection is closed.
+func (client Client) receive(l link, buff *bufio.Reader) {
+	if err := l.receive(buff); err != nil {
+		fmt.Println(err)
 	}
+
+	l.tunnel.markClosed()
+	l.conn.Close()
 }
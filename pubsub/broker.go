@@ -0,0 +1,172 @@
+package pubsub
+
+import (
+	"sync"
+
+	"github.com/clagraff/devoid/actions"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Handle identifies a subscription made with a Broker, so that it can later
+// be removed.
+type Handle uint64
+
+// Broker delivers published notifications to the subscribers of their
+// topics. It is safe for concurrent use. Subscribers are notified without
+// the broker's lock held, so they may subscribe and unsubscribe themselves.
+type Broker struct {
+	mux *sync.Mutex
+
+	lastHandle Handle
+	byHandle   map[Handle]Subscriber
+	byTopic    map[Topic][]Handle
+	following  map[uuid.UUID][]Handle
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		mux:       new(sync.Mutex),
+		byHandle:  make(map[Handle]Subscriber),
+		byTopic:   make(map[Topic][]Handle),
+		following: make(map[uuid.UUID][]Handle),
+	}
+}
+
+// Subscribe registers sub for notifications on its NotifyOn topics,
+// returning a handle with which to unsubscribe it.
+func (broker *Broker) Subscribe(sub Subscriber) Handle {
+	broker.mux.Lock()
+	defer broker.mux.Unlock()
+
+	broker.lastHandle++
+	handle := broker.lastHandle
+
+	broker.byHandle[handle] = sub
+	broker.index(handle, sub)
+
+	if follower, ok := sub.(Follower); ok {
+		id := follower.Following()
+		broker.following[id] = append(broker.following[id], handle)
+	}
+
+	return handle
+}
+
+// Unsubscribe removes the subscription with the given handle. Removing a
+// subscription which no longer exists is not an error.
+func (broker *Broker) Unsubscribe(handle Handle) {
+	broker.mux.Lock()
+	defer broker.mux.Unlock()
+
+	broker.unsubscribe(handle)
+}
+
+// Publish delivers the notification once to every subscriber of a topic
+// covering the notification's topic, removing those which do not wish to be
+// retained. Followers of an entity moved by one of the notification's
+// actions are then re-subscribed around its new position.
+func (broker *Broker) Publish(notification Notification) {
+	handles, subs := broker.match(notification.Topic)
+
+	for i, sub := range subs {
+		if retain := sub.Notify(notification); !retain {
+			broker.Unsubscribe(handles[i])
+		}
+	}
+
+	broker.refollow(notification)
+}
+
+// match returns the subscriptions interested in the topic, without
+// duplicates.
+func (broker *Broker) match(topic Topic) ([]Handle, []Subscriber) {
+	broker.mux.Lock()
+	defer broker.mux.Unlock()
+
+	handles := make([]Handle, 0)
+	subs := make([]Subscriber, 0)
+
+	if topic == nil {
+		return handles, subs
+	}
+
+	matched := make(map[Handle]bool)
+	for _, covering := range topic.covers() {
+		for _, handle := range broker.byTopic[covering] {
+			if matched[handle] {
+				continue
+			}
+			matched[handle] = true
+
+			handles = append(handles, handle)
+			subs = append(subs, broker.byHandle[handle])
+		}
+	}
+
+	return handles, subs
+}
+
+func (broker *Broker) refollow(notification Notification) {
+	broker.mux.Lock()
+	defer broker.mux.Unlock()
+
+	for _, action := range notification.Actions {
+		moveTo, ok := action.(actions.MoveTo)
+		if !ok {
+			continue
+		}
+
+		for _, handle := range broker.following[moveTo.SourceID] {
+			follower := broker.byHandle[handle].(Follower)
+
+			broker.unindex(handle, follower)
+			follower.Follow(moveTo.Position)
+			broker.index(handle, follower)
+		}
+	}
+}
+
+func (broker *Broker) unsubscribe(handle Handle) {
+	sub, ok := broker.byHandle[handle]
+	if !ok {
+		return
+	}
+
+	broker.unindex(handle, sub)
+	delete(broker.byHandle, handle)
+
+	if follower, ok := sub.(Follower); ok {
+		id := follower.Following()
+		if handles := removeHandle(broker.following[id], handle); len(handles) > 0 {
+			broker.following[id] = handles
+		} else {
+			delete(broker.following, id)
+		}
+	}
+}
+
+func (broker *Broker) index(handle Handle, sub Subscriber) {
+	for _, topic := range sub.NotifyOn() {
+		broker.byTopic[topic] = append(broker.byTopic[topic], handle)
+	}
+}
+
+func (broker *Broker) unindex(handle Handle, sub Subscriber) {
+	for _, topic := range sub.NotifyOn() {
+		if handles := removeHandle(broker.byTopic[topic], handle); len(handles) > 0 {
+			broker.byTopic[topic] = handles
+		} else {
+			delete(broker.byTopic, topic)
+		}
+	}
+}
+
+func removeHandle(handles []Handle, handle Handle) []Handle {
+	for i, h := range handles {
+		if h == handle {
+			return append(handles[:i:i], handles[i+1:]...)
+		}
+	}
+	return handles
+}
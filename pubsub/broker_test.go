@@ -0,0 +1,226 @@
+package pubsub_test
+
+import (
+	"testing"
+
+	"github.com/clagraff/devoid/actions"
+	"github.com/clagraff/devoid/components"
+	"github.com/clagraff/devoid/pubsub"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// recorder counts the notifications delivered to it, asking to be retained
+// only while retain is set.
+type recorder struct {
+	received []pubsub.Notification
+	retain   bool
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		received: make([]pubsub.Notification, 0),
+		retain:   true,
+	}
+}
+
+func (r *recorder) notify(notification pubsub.Notification) bool {
+	r.received = append(r.received, notification)
+	return r.retain
+}
+
+// expect fails the test unless the recorder has received exactly n
+// notifications.
+func (r *recorder) expect(t *testing.T, n int, context string) {
+	t.Helper()
+
+	if len(r.received) != n {
+		t.Errorf("%s: expected %d notifications, got %d", context, n, len(r.received))
+	}
+}
+
+func publish(broker *pubsub.Broker, topic pubsub.Topic) {
+	broker.Publish(pubsub.Notification{Topic: topic})
+}
+
+func TestSubscribeAndUnsubscribe(t *testing.T) {
+	broker := pubsub.NewBroker()
+	topic := pubsub.EntityTopic(uuid.Must(uuid.NewV4()))
+
+	first, second := newRecorder(), newRecorder()
+	firstHandle := broker.Subscribe(pubsub.MakeSubscriber(first.notify, topic))
+	secondHandle := broker.Subscribe(pubsub.MakeSubscriber(second.notify, topic))
+
+	if firstHandle == secondHandle {
+		t.Fatalf("both subscriptions were given handle %d", firstHandle)
+	}
+
+	publish(broker, topic)
+	first.expect(t, 1, "first subscriber")
+	second.expect(t, 1, "second subscriber")
+
+	broker.Unsubscribe(firstHandle)
+	publish(broker, topic)
+	first.expect(t, 1, "unsubscribed subscriber")
+	second.expect(t, 2, "remaining subscriber")
+
+	// Removing a subscription twice, or one which never existed, is harmless.
+	broker.Unsubscribe(firstHandle)
+	broker.Unsubscribe(secondHandle + 100)
+
+	broker.Unsubscribe(secondHandle)
+	publish(broker, topic)
+	second.expect(t, 2, "every subscriber removed")
+}
+
+func TestPublishOnlyReachesMatchingTopics(t *testing.T) {
+	broker := pubsub.NewBroker()
+
+	entity := newRecorder()
+	broker.Subscribe(pubsub.MakeSubscriber(entity.notify, pubsub.EntityTopic(uuid.Must(uuid.NewV4()))))
+
+	position := newRecorder()
+	broker.Subscribe(pubsub.MakeSubscriber(position.notify, pubsub.PositionTopic(components.Position{X: 1, Y: 1})))
+
+	publish(broker, pubsub.EntityTopic(uuid.Must(uuid.NewV4())))
+	publish(broker, pubsub.PositionTopic(components.Position{X: 1, Y: 2}))
+	publish(broker, pubsub.Global)
+	publish(broker, nil)
+
+	entity.expect(t, 0, "another entity's topic")
+	position.expect(t, 0, "another position's topic")
+}
+
+func TestChunkCoversItsPositions(t *testing.T) {
+	cases := []struct {
+		pos   components.Position
+		chunk pubsub.Chunk
+	}{
+		{components.Position{X: 0, Y: 0}, pubsub.Chunk{X: 0, Y: 0}},
+		{components.Position{X: 15, Y: 15}, pubsub.Chunk{X: 0, Y: 0}},
+		{components.Position{X: 16, Y: 3}, pubsub.Chunk{X: 1, Y: 0}},
+		{components.Position{X: -1, Y: -16}, pubsub.Chunk{X: -1, Y: -1}},
+		{components.Position{X: -17, Y: 0}, pubsub.Chunk{X: -2, Y: 0}},
+	}
+
+	for _, c := range cases {
+		if chunk := pubsub.ChunkOf(c.pos); chunk != c.chunk {
+			t.Errorf("expected %+v in %+v, not %+v", c.pos, c.chunk, chunk)
+		}
+
+		broker := pubsub.NewBroker()
+		inside, outside := newRecorder(), newRecorder()
+		broker.Subscribe(pubsub.MakeSubscriber(inside.notify, c.chunk))
+		broker.Subscribe(pubsub.MakeSubscriber(outside.notify, pubsub.Chunk{X: c.chunk.X + 1, Y: c.chunk.Y}))
+
+		publish(broker, pubsub.PositionTopic(c.pos))
+		inside.expect(t, 1, "containing chunk")
+		outside.expect(t, 0, "neighbouring chunk")
+	}
+}
+
+func TestAnyReceivesEveryTopic(t *testing.T) {
+	broker := pubsub.NewBroker()
+
+	wildcard := newRecorder()
+	broker.Subscribe(pubsub.MakeSubscriber(wildcard.notify, pubsub.Any))
+
+	publish(broker, pubsub.EntityTopic(uuid.Must(uuid.NewV4())))
+	publish(broker, pubsub.PositionTopic(components.Position{X: -5, Y: 40}))
+	publish(broker, pubsub.Chunk{X: 3, Y: 3})
+	publish(broker, pubsub.Global)
+	publish(broker, pubsub.Any)
+
+	wildcard.expect(t, 5, "wildcard subscriber")
+}
+
+func TestPublishDeduplicatesSubscribers(t *testing.T) {
+	broker := pubsub.NewBroker()
+	pos := components.Position{X: 2, Y: 3}
+
+	sub := newRecorder()
+	broker.Subscribe(pubsub.MakeSubscriber(
+		sub.notify,
+		pubsub.PositionTopic(pos),
+		pubsub.ChunkOf(pos),
+		pubsub.Any,
+		pubsub.PositionTopic(pos),
+	))
+
+	publish(broker, pubsub.PositionTopic(pos))
+	sub.expect(t, 1, "subscriber matched by several topics")
+}
+
+func TestNotRetainedSubscriberIsRemoved(t *testing.T) {
+	broker := pubsub.NewBroker()
+
+	once := newRecorder()
+	once.retain = false
+	broker.Subscribe(pubsub.MakeSubscriber(once.notify, pubsub.Global, pubsub.Any))
+
+	kept := newRecorder()
+	broker.Subscribe(pubsub.MakeSubscriber(kept.notify, pubsub.Global))
+
+	publish(broker, pubsub.Global)
+	publish(broker, pubsub.Global)
+
+	once.expect(t, 1, "subscriber not retained")
+	kept.expect(t, 2, "retained subscriber")
+}
+
+func TestFollowerRefollowsAfterMoveTo(t *testing.T) {
+	broker := pubsub.NewBroker()
+	id := uuid.Must(uuid.NewV4())
+
+	start := components.Position{X: 1, Y: 1}
+	destination := components.Position{X: 100, Y: 100}
+
+	sub := newRecorder()
+	broker.Subscribe(pubsub.MakeFollower(sub.notify, id, start, 0))
+
+	publish(broker, pubsub.PositionTopic(destination))
+	sub.expect(t, 0, "before moving, a distant position")
+
+	// The follower hears about its own move on its entity topic, even though
+	// the destination is outside its area.
+	broker.Publish(pubsub.Notification{
+		Topic:   pubsub.EntityTopic(id),
+		Actions: []actions.Action{actions.MoveTo{SourceID: id, Position: destination}},
+	})
+	sub.expect(t, 1, "its own move")
+
+	publish(broker, pubsub.PositionTopic(start))
+	sub.expect(t, 1, "after moving, the position it left")
+
+	publish(broker, pubsub.PositionTopic(destination))
+	sub.expect(t, 2, "after moving, its new position")
+
+	publish(broker, pubsub.EntityTopic(id))
+	publish(broker, pubsub.Global)
+	sub.expect(t, 4, "its entity and the global topic")
+}
+
+func TestRefollowOnlyMovesTheMovedEntitysFollowers(t *testing.T) {
+	broker := pubsub.NewBroker()
+	moved, other := uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4())
+
+	start := components.Position{X: 1, Y: 1}
+	destination := components.Position{X: 100, Y: 100}
+
+	bystander := newRecorder()
+	broker.Subscribe(pubsub.MakeFollower(bystander.notify, other, start, 0))
+
+	handle := broker.Subscribe(pubsub.MakeFollower(newRecorder().notify, moved, start, 0))
+	broker.Unsubscribe(handle)
+
+	// Moving an entity whose only follower was removed must not panic.
+	broker.Publish(pubsub.Notification{
+		Topic:   pubsub.PositionTopic(start),
+		Actions: []actions.Action{actions.MoveTo{SourceID: moved, Position: destination}},
+	})
+	bystander.expect(t, 1, "a move at its position")
+
+	publish(broker, pubsub.PositionTopic(start))
+	publish(broker, pubsub.PositionTopic(destination))
+	bystander.expect(t, 2, "after another entity moved")
+}
@@ -0,0 +1,114 @@
+package pubsub
+
+import (
+	"github.com/clagraff/devoid/components"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// ChunkSize is the width and height, in positions, of a Chunk.
+const ChunkSize = 16
+
+// Chunk is a square region of the world, and the topic of notifications
+// about it. Notifications about a position are also delivered to
+// subscribers of the chunk containing it, so subscribers can hear about an
+// area without subscribing to every position in it.
+type Chunk struct {
+	X int
+	Y int
+}
+
+func (topic Chunk) covers() []Topic {
+	return []Topic{topic, Any}
+}
+
+// ChunkOf returns the chunk containing pos.
+func ChunkOf(pos components.Position) Chunk {
+	return Chunk{
+		X: floorDiv(pos.X, ChunkSize),
+		Y: floorDiv(pos.Y, ChunkSize),
+	}
+}
+
+func floorDiv(n, d int) int {
+	q := n / d
+	if n%d != 0 && n < 0 {
+		q--
+	}
+	return q
+}
+
+// ChunksAround returns every chunk within radius chunks of the chunk
+// containing pos, including that chunk itself.
+func ChunksAround(pos components.Position, radius int) []Chunk {
+	center := ChunkOf(pos)
+	chunks := make([]Chunk, 0, (2*radius+1)*(2*radius+1))
+
+	for y := center.Y - radius; y <= center.Y+radius; y++ {
+		for x := center.X - radius; x <= center.X+radius; x++ {
+			chunks = append(chunks, Chunk{X: x, Y: y})
+		}
+	}
+
+	return chunks
+}
+
+// Follower is a Subscriber whose interest is the area around an entity.
+// Whenever a Broker publishes a MoveTo of the followed entity, Follow is
+// called with its new position and the follower is re-subscribed on its new
+// NotifyOn.
+type Follower interface {
+	Subscriber
+	Following() uuid.UUID
+	Follow(components.Position)
+}
+
+type follower struct {
+	notify   func(Notification) bool
+	entityID uuid.UUID
+	radius   int
+	notifyOn []Topic
+}
+
+// MakeFollower returns a Follower of the entity, notified about the entity
+// itself, the Global topic, and every chunk within radius chunks of its
+// position.
+func MakeFollower(
+	notify func(Notification) bool,
+	entityID uuid.UUID,
+	pos components.Position,
+	radius int,
+) Follower {
+	sub := &follower{
+		notify:   notify,
+		entityID: entityID,
+		radius:   radius,
+	}
+	sub.Follow(pos)
+
+	return sub
+}
+
+func (sub *follower) Notify(notification Notification) bool {
+	return sub.notify(notification)
+}
+
+func (sub *follower) NotifyOn() []Topic {
+	return sub.notifyOn
+}
+
+func (sub *follower) Following() uuid.UUID {
+	return sub.entityID
+}
+
+func (sub *follower) Follow(pos components.Position) {
+	chunks := ChunksAround(pos, sub.radius)
+
+	notifyOn := make([]Topic, 0, len(chunks)+2)
+	notifyOn = append(notifyOn, EntityTopic(sub.entityID), Global)
+	for _, chunk := range chunks {
+		notifyOn = append(notifyOn, chunk)
+	}
+
+	sub.notifyOn = notifyOn
+}
@@ -4,30 +4,34 @@ import (
 	"github.com/clagraff/devoid/actions"
 )
 
+// Notification carries actions to the subscribers of its topic.
 type Notification struct {
-	Type    interface{}
+	Topic   Topic
 	Actions []actions.Action
 }
 
+// Subscriber receives the notifications published on any of the topics
+// returned by NotifyOn. Notify returns false if the subscriber should be
+// unsubscribed.
 type Subscriber interface {
 	Notify(Notification) bool
-	NotifyOn() []interface{}
+	NotifyOn() []Topic
 }
 
 type customSubscriber struct {
 	notify   func(Notification) bool
-	notifyOn []interface{}
+	notifyOn []Topic
 }
 
 func (sub customSubscriber) Notify(notification Notification) bool {
 	return sub.notify(notification)
 }
 
-func (sub customSubscriber) NotifyOn() []interface{} {
+func (sub customSubscriber) NotifyOn() []Topic {
 	return sub.notifyOn
 }
 
-func MakeSubscriber(notify func(Notification) bool, notifyOn ...interface{}) Subscriber {
+func MakeSubscriber(notify func(Notification) bool, notifyOn ...Topic) Subscriber {
 	return customSubscriber{
 		notify:   notify,
 		notifyOn: notifyOn,
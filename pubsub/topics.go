@@ -0,0 +1,51 @@
+package pubsub
+
+import (
+	"github.com/clagraff/devoid/components"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Topic identifies what a notification is about. A notification is
+// delivered to the subscribers of its own topic and of every broader topic
+// which covers it, such as the chunk containing a position.
+type Topic interface {
+	// covers returns the topics whose subscribers receive notifications
+	// published on this topic, including the topic itself.
+	covers() []Topic
+}
+
+// EntityTopic is the topic of notifications about a single entity.
+type EntityTopic uuid.UUID
+
+func (topic EntityTopic) covers() []Topic {
+	return []Topic{topic, Any}
+}
+
+// PositionTopic is the topic of notifications about a single position. Its
+// notifications are also delivered to subscribers of the containing Chunk.
+type PositionTopic components.Position
+
+func (topic PositionTopic) covers() []Topic {
+	return []Topic{topic, ChunkOf(components.Position(topic)), Any}
+}
+
+type globalTopic struct{}
+
+func (topic globalTopic) covers() []Topic {
+	return []Topic{topic, Any}
+}
+
+// Global is the topic of notifications about the world as a whole, such as
+// announcements to every client.
+var Global Topic = globalTopic{}
+
+type anyTopic struct{}
+
+func (topic anyTopic) covers() []Topic {
+	return []Topic{topic}
+}
+
+// Any is a wildcard topic: its subscribers receive every notification,
+// whatever topic it is published on.
+var Any Topic = anyTopic{}
@@ -0,0 +1,107 @@
+//go:build !windows
+
+package server
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/clagraff/devoid/components"
+	"github.com/clagraff/devoid/entities"
+	"github.com/clagraff/devoid/network"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// cpuTime returns the user and system CPU time used by the process so far.
+func cpuTime(t *testing.T) time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		t.Fatal(err)
+	}
+
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// measureLoad returns the fraction of one core the process uses while
+// sleeping for d.
+func measureLoad(t *testing.T, d time.Duration) float64 {
+	startCPU, start := cpuTime(t), time.Now()
+	time.Sleep(d)
+	used, elapsed := cpuTime(t)-startCPU, time.Since(start)
+
+	return float64(used) / float64(elapsed)
+}
+
+// TestIdleServeUsesLittleCPU checks that a server whose clients send
+// nothing blocks, rather than polling its tunnels and queues.
+func TestIdleServeUsesLittleCPU(t *testing.T) {
+	if testing.Short() {
+		t.Skip("measures CPU use over a second")
+	}
+
+	const (
+		idleTunnels = 200
+		measured    = time.Second
+
+		// maxLoad is the fraction of one core an idle server may use. A
+		// single busy-wait loop uses all of it.
+		maxLoad = 0.1
+	)
+
+	locker := entities.MakeLocker()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tunnels := make(chan network.Tunnel, idleTunnels)
+	served := make(chan struct{})
+	go func() {
+		Serve(ctx, Config{}, &locker, denyAll{}, tunnels)
+		close(served)
+	}()
+
+	greeted := make(chan struct{}, idleTunnels)
+	drained := make(chan struct{}, idleTunnels)
+	for i := 0; i < idleTunnels; i++ {
+		id := uuid.Must(uuid.NewV4())
+		locker.Set(entities.Entity{
+			ID: id,
+			Components: components.MakeSet(
+				components.Position{X: i * 3, Y: 0},
+				components.Spatial{Stackable: false},
+			),
+		})
+
+		tunnel := makeTunnel(id)
+		go func() {
+			if _, ok := <-tunnel.Outgoing; ok {
+				greeted <- struct{}{}
+			}
+			for range tunnel.Outgoing {
+			}
+			drained <- struct{}{}
+		}()
+		tunnels <- tunnel
+	}
+
+	// Let every tunnel be picked up and sent its first Perceive.
+	for i := 0; i < idleTunnels; i++ {
+		<-greeted
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	load := measureLoad(t, measured)
+
+	cancel()
+	<-served
+	for i := 0; i < idleTunnels; i++ {
+		<-drained
+	}
+
+	t.Logf("%d idle tunnels used %.1f%% of a core", idleTunnels, load*100)
+
+	if load > maxLoad {
+		t.Errorf("idle server used %.1f%% of a core, more than %.1f%%", load*100, maxLoad*100)
+	}
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/clagraff/devoid/actions"
+	"github.com/clagraff/devoid/commands"
+	"github.com/clagraff/devoid/components"
+	"github.com/clagraff/devoid/entities"
+	"github.com/clagraff/devoid/network"
+	"github.com/clagraff/devoid/pubsub"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// player is a simulated client in the load test.
+type player struct {
+	tunnel network.Tunnel
+	start  components.Position
+
+	// neighbour is another player's entity, which this one may not control.
+	neighbour uuid.UUID
+}
+
+// send encodes the command with the tunnel's codec and feeds it to the
+// server as if it had arrived over the network.
+func (p player) send(t *testing.T, command commands.Command) {
+	kind, err := commands.KindOf(command)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	message, err := p.tunnel.MakeMessage(kind, command)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	p.tunnel.Incoming <- message
+}
+
+// play sends the player's commands, and checks that the rejections of the
+// ones the server refuses come back on its own tunnel. The only move it may
+// be told of is its own.
+func (p player) play(t *testing.T, timeout time.Duration) {
+	id := p.tunnel.EntityID
+	moved := components.Position{X: p.start.X + 1, Y: p.start.Y}
+
+	p.send(t, commands.Move{SourceID: id, Position: moved})
+	p.send(t, commands.Move{SourceID: id, Position: components.Position{X: moved.X + 5, Y: moved.Y}})
+	p.send(t, commands.Move{SourceID: p.neighbour, Position: p.start})
+
+	expected := map[commands.Reason]uuid.UUID{
+		commands.ReasonTooFar:    id,
+		commands.ReasonForbidden: p.neighbour,
+	}
+
+	deadline := time.After(timeout)
+	for len(expected) > 0 {
+		var message network.Message
+		select {
+		case message = <-p.tunnel.Outgoing:
+		case <-deadline:
+			t.Errorf("tunnel %s is still waiting for %d rejections", p.tunnel.ID, len(expected))
+			return
+		}
+
+		if message.ContentType == "move-to" {
+			var moveTo actions.MoveTo
+			if err := message.Decode(&moveTo); err != nil {
+				t.Error(err)
+				return
+			}
+
+			if !uuid.Equal(moveTo.SourceID, id) || moveTo.Position != moved {
+				t.Errorf("tunnel %s was told of an unexpected move: %+v", p.tunnel.ID, moveTo)
+			}
+			continue
+		}
+
+		if message.ContentType != "command-rejected" {
+			continue
+		}
+
+		var rejected actions.CommandRejected
+		if err := message.Decode(&rejected); err != nil {
+			t.Error(err)
+			return
+		}
+
+		reason := commands.Reason(rejected.Reason)
+		source, ok := expected[reason]
+		if !ok {
+			t.Errorf("tunnel %s received an unexpected rejection: %s", p.tunnel.ID, rejected)
+			continue
+		}
+
+		if !uuid.Equal(rejected.SourceID, source) {
+			t.Errorf(
+				"tunnel %s received the %s rejection of entity %s, not %s",
+				p.tunnel.ID,
+				reason,
+				rejected.SourceID,
+				source,
+			)
+		}
+		delete(expected, reason)
+	}
+}
+
+// TestServeManyTunnels feeds hundreds of in-memory tunnels into Serve at
+// once, checking that each command is applied to, or rejected back to, the
+// tunnel which sent it.
+func TestServeManyTunnels(t *testing.T) {
+	const players = 300
+
+	locker := entities.MakeLocker()
+
+	// Players are spread out so that they never share an area of interest,
+	// and so never hear about each other.
+	spacing := pubsub.ChunkSize * (2*interestRadius + 2)
+
+	ids := make([]uuid.UUID, players)
+	for i := range ids {
+		ids[i] = uuid.Must(uuid.NewV4())
+	}
+
+	simulated := make([]player, players)
+	codecs := network.Codecs()
+	for i, id := range ids {
+		start := components.Position{X: (i % 20) * spacing, Y: (i / 20) * spacing}
+		locker.Set(entities.Entity{
+			ID: id,
+			Components: components.MakeSet(
+				start,
+				components.Spatial{Stackable: false},
+			),
+		})
+
+		tunnel := makeTunnel(id)
+		tunnel.Codec = codecs[i%len(codecs)]
+
+		simulated[i] = player{
+			tunnel:    tunnel,
+			start:     start,
+			neighbour: ids[(i+1)%players],
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tunnels := make(chan network.Tunnel, players)
+	served := make(chan struct{})
+	go func() {
+		Serve(ctx, Config{TickRate: 50}, &locker, denyAll{}, tunnels)
+		close(served)
+	}()
+
+	for _, p := range simulated {
+		tunnels <- p.tunnel
+	}
+
+	wg := new(sync.WaitGroup)
+	for _, p := range simulated {
+		wg.Add(1)
+		go func(p player) {
+			defer wg.Done()
+			p.play(t, 10*time.Second)
+		}(p)
+	}
+	wg.Wait()
+
+	cancel()
+	<-served
+
+	for _, p := range simulated {
+		for range p.tunnel.Outgoing {
+		}
+
+		entity, err := locker.GetByID(p.tunnel.EntityID)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		expected := components.Position{X: p.start.X + 1, Y: p.start.Y}
+		if pos, _ := entity.Position(); pos != expected {
+			t.Errorf("entity %s is at %+v, not %+v", entity.ID, pos, expected)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/clagraff/devoid/commands"
+	"github.com/clagraff/devoid/components"
+	"github.com/clagraff/devoid/entities"
+	"github.com/clagraff/devoid/network"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// expectMessage waits for a message of the provided kind on the tunnel,
+// skipping any others.
+func expectMessage(t *testing.T, tunnel network.Tunnel, kind string) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		message := receive(t, tunnel, time.Until(deadline))
+		if message.ContentType == kind {
+			return
+		}
+	}
+}
+
+func TestDoorChangesReachNeighbours(t *testing.T) {
+	locker := entities.MakeLocker()
+
+	door := uuid.Must(uuid.NewV4())
+	opener, neighbour := uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4())
+
+	locker.Set(entities.Entity{
+		ID: door,
+		Components: components.MakeSet(
+			components.Position{X: 5, Y: 5},
+			components.Spatial{Stackable: false, Toggleable: true},
+		),
+	})
+	for id, pos := range map[uuid.UUID]components.Position{
+		opener:    {X: 4, Y: 5},
+		neighbour: {X: 6, Y: 5},
+	} {
+		locker.Set(entities.Entity{
+			ID:         id,
+			Components: components.MakeSet(pos, components.Spatial{}),
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tunnels := make(chan network.Tunnel, 2)
+	go Serve(ctx, Config{TickRate: 50}, &locker, denyAll{}, tunnels)
+
+	openerTunnel, neighbourTunnel := makeTunnel(opener), makeTunnel(neighbour)
+	tunnels <- openerTunnel
+	tunnels <- neighbourTunnel
+
+	// Wait for both to be subscribed, which happens before their Perceive.
+	expectMessage(t, openerTunnel, "set-entity")
+	expectMessage(t, neighbourTunnel, "set-entity")
+
+	message, err := openerTunnel.MakeMessage("open-spatial", commands.OpenSpatial{
+		SourceID: opener,
+		TargetID: door,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	openerTunnel.Incoming <- message
+
+	expectMessage(t, openerTunnel, "set-stackability")
+	expectMessage(t, neighbourTunnel, "set-stackability")
+}
@@ -1,180 +1,476 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/clagraff/devoid/actions"
 	"github.com/clagraff/devoid/commands"
+	"github.com/clagraff/devoid/components"
 	"github.com/clagraff/devoid/entities"
 	"github.com/clagraff/devoid/network"
 	"github.com/clagraff/devoid/pubsub"
 
+	errs "github.com/go-errors/errors"
 	uuid "github.com/satori/go.uuid"
 )
 
-func Serve(locker *entities.Locker, tunnels chan network.Tunnel) {
-	commandsQueue := make(chan commands.Command, 100)
-	notificationsQueue := make(chan pubsub.Notification, 100)
-	messagesQueue := make(chan network.Message, 100)
-	subscriberQueue := make(chan pubsub.Subscriber, 100)
+// Config holds the tunable settings of the game server.
+type Config struct {
+	// TickRate is the number of world ticks simulated per second.
+	TickRate int
+}
 
-	go handleTunnels(locker, tunnels, messagesQueue, commandsQueue, subscriberQueue)
-	go handleCommands(locker, commandsQueue, notificationsQueue)
-	go handleNotifications(
-		notificationsQueue,
-		messagesQueue,
-		subscriberQueue,
-	)
+// DefaultTickRate is used when a Config does not specify a TickRate.
+const DefaultTickRate = 10
 
-	select {}
+// Authorizer decides whether a client may issue commands on behalf of an
+// entity other than the one its tunnel is bound to.
+type Authorizer interface {
+	CanControl(clientID uuid.UUID, entityID uuid.UUID) bool
 }
 
-func handleTunnels(
+// Serve runs the game server until ctx is cancelled. Commands acting on an
+// entity other than the tunnel's own are rejected unless auth allows them.
+// Before returning, it stops reading from tunnels, drains any queued
+// commands and notifications, and sends every connected client a Disconnect
+// before closing its tunnel.
+func Serve(
+	ctx context.Context,
+	cfg Config,
 	locker *entities.Locker,
+	auth Authorizer,
 	tunnels chan network.Tunnel,
-	messagesQueue chan network.Message,
-	commandsQueue chan commands.Command,
-	subscriberQueue chan pubsub.Subscriber,
 ) {
-	availableTunnels := make(map[uuid.UUID]network.Tunnel)
-	for {
+	if cfg.TickRate <= 0 {
+		cfg.TickRate = DefaultTickRate
+	}
+
+	requests := make(chan request, 100)
+	notificationsQueue := make(chan []pubsub.Notification, 100)
+	broker := pubsub.NewBroker()
+	memory := commands.NewMemory()
+
+	var sessions map[uuid.UUID]*session
+
+	tunnelsDone := make(chan struct{})
+	notificationsDone := make(chan struct{})
+
+	go func() {
+		sessions = handleTunnels(
+			ctx,
+			locker,
+			memory,
+			broker,
+			auth,
+			tunnels,
+			requests,
+		)
+		close(requests)
+		close(tunnelsDone)
+	}()
+	go func() {
+		handleCommands(locker, memory, cfg.TickRate, requests, notificationsQueue)
+		close(notificationsQueue)
+	}()
+	go func() {
+		handleNotifications(notificationsQueue, broker)
+		close(notificationsDone)
+	}()
+
+	<-tunnelsDone
+	<-notificationsDone
+
+	// Tunnels which completed their handshake but were never picked up.
+	for pending := true; pending; {
 		select {
 		case tunnel := <-tunnels:
-			availableTunnels[tunnel.ID] = tunnel
-			handleSubscribe(locker, tunnel, subscriberQueue)
-			commandsQueue <- commands.Perceive{SourceID: tunnel.ID}
-		case message := <-messagesQueue:
-			clientID := message.ClientID
-			if tunnel, ok := availableTunnels[clientID]; ok {
-				tunnel.Outgoing <- message
-			} else {
-				fmt.Println("tunnel no longer available for client to receive outgoing message")
+			if previous, ok := sessions[tunnel.ID]; ok {
+				previous.close()
 			}
+			sessions[tunnel.ID] = newSession(tunnel)
 		default:
-			// no-op
+			pending = false
 		}
+	}
 
-		for _, tunnel := range availableTunnels {
-			select {
-			case _ = <-tunnel.Closed:
-				delete(availableTunnels, tunnel.ID)
-			case message := <-tunnel.Incoming:
-				command, err := commands.Unmarshal(message.ContentType, message.Content)
-				if err != nil {
-					tunnel.Closed <- struct{}{}
-					panic(err)
-				}
+	disconnect := actions.Disconnect{Reason: "server is shutting down"}
+	for _, sess := range sessions {
+		sess.deliverAction(disconnect)
+		sess.close()
+	}
+}
+
+// handleTunnels starts a reader for each new tunnel until ctx is cancelled,
+// spawning the tunnel's entity if it does not yet exist. It returns the
+// sessions of the tunnels which are still open once every reader has
+// stopped. Tunnels whose connection ends are unsubscribed and closed as soon
+// as that is noticed, and those whose entity cannot be spawned or followed
+// are sent a Disconnect and closed straight away.
+func handleTunnels(
+	ctx context.Context,
+	locker *entities.Locker,
+	memory *commands.Memory,
+	broker *pubsub.Broker,
+	auth Authorizer,
+	tunnels chan network.Tunnel,
+	requests chan request,
+) map[uuid.UUID]*session {
+	sessions := make(map[uuid.UUID]*session)
+
+	closeSession := func(sess *session) {
+		for _, handle := range sess.handles {
+			broker.Unsubscribe(handle)
+		}
+		sess.close()
+		memory.Forget(sess.tunnel.EntityID)
+	}
+
+	closed := make(chan *session, 100)
+	readers := new(sync.WaitGroup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			readers.Wait()
+			return sessions
+		case tunnel := <-tunnels:
+			if previous, ok := sessions[tunnel.ID]; ok {
+				closeSession(previous)
+			}
+
+			sess := newSession(tunnel)
+			sessions[tunnel.ID] = sess
+
+			memory.Forget(tunnel.EntityID)
+			err := handleSpawn(locker, tunnel.EntityID)
+			if err == nil {
+				err = handleSubscribe(locker, broker, sess)
+			}
+			if err != nil {
+				// The client could not play, so it is told why rather than
+				// being left connected to a session that never updates.
+				fmt.Println("could not start tunnel", tunnel.ID, err)
+				sess.deliverAction(actions.Disconnect{Reason: err.Error()})
+				delete(sessions, tunnel.ID)
+				closeSession(sess)
+				continue
+			}
 
-				commandsQueue <- command
-			default:
-				// no-op
+			readers.Add(1)
+			go func() {
+				defer readers.Done()
+				sess.read(ctx, auth, requests, closed)
+			}()
+
+			requests <- request{
+				command: commands.Perceive{SourceID: tunnel.EntityID},
+				sess:    sess,
+			}
+		case sess := <-closed:
+			// A replaced session was closed when its replacement arrived.
+			if sessions[sess.tunnel.ID] == sess {
+				delete(sessions, sess.tunnel.ID)
+				closeSession(sess)
 			}
 		}
 	}
 }
 
-func handleSubscribe(
-	locker *entities.Locker,
-	tunnel network.Tunnel,
-	subscriberQueue chan pubsub.Subscriber,
-) {
-	entity, err := locker.GetByID(tunnel.ID)
+// actionMessage wraps action in a Message to the tunnel's client.
+func actionMessage(tunnel network.Tunnel, action actions.Action) (network.Message, error) {
+	kind, err := actions.KindOf(action)
 	if err != nil {
-		panic(err)
+		return network.Message{}, err
 	}
 
-	subscribers := []pubsub.Subscriber{
-		pubsub.MakeSubscriber(
-			func(notification pubsub.Notification) bool {
-				for _, action := range notification.Actions {
-					tunnel.Outgoing <- network.MakeMessage(
-						tunnel.ID,
-						action,
-					)
-				}
-				return true
-			},
-			entity.Position,
-			entity.ID,
-			nil),
+	return tunnel.MakeMessage(kind, action)
+}
+
+// interestRadius is how many chunks around its entity, in each direction,
+// a tunnel is notified about.
+const interestRadius = 1
+
+// handleSpawn creates the entity with the provided id, if it does not yet
+// exist, at the first Spawn point not occupied by a blocking entity. Spawn
+// points are tried in order of their position, row by row.
+func handleSpawn(locker *entities.Locker, id uuid.UUID) error {
+	return locker.Transaction(func(tx *entities.Tx) error {
+		if _, err := tx.GetByID(id); err == nil {
+			return nil
+		}
+
+		points := make([]components.Position, 0)
+		for _, spawn := range tx.Query(components.Spawn{}, components.Position{}) {
+			pos, _ := spawn.Position()
+			points = append(points, pos)
+		}
+
+		sort.Slice(points, func(i, j int) bool {
+			if points[i].Y != points[j].Y {
+				return points[i].Y < points[j].Y
+			}
+			return points[i].X < points[j].X
+		})
+
+		for _, pos := range points {
+			if blocked(tx, pos) {
+				continue
+			}
+
+			return tx.Set(entities.Entity{
+				ID: id,
+				Components: components.MakeSet(
+					pos,
+					components.Spatial{Stackable: false},
+				),
+			})
+		}
+
+		return errs.Errorf("no free spawn point for entity %s", id)
+	})
+}
+
+// blocked reports whether an entity at pos prevents others from sharing it.
+func blocked(store entities.Store, pos components.Position) bool {
+	occupants, err := store.GetByPosition(pos)
+	if err != nil {
+		return false
 	}
 
-	for _, sub := range subscribers {
-		subscriberQueue <- sub
+	for _, occupant := range occupants {
+		if occupant.Blocks() {
+			return true
+		}
 	}
+	return false
 }
 
-func handleNotifications(
-	queue chan pubsub.Notification,
-	messagesQueue chan network.Message,
-	subscriberQueue chan pubsub.Subscriber,
-) {
-	subscribers := make(map[interface{}][]pubsub.Subscriber)
+// handleSubscribe subscribes the session to its entity and the area around
+// it, recording the subscription's handle on the session. A session which
+// cannot keep up with its notifications is unsubscribed, and cleaned up by
+// handleTunnels once its reader reports it.
+func handleSubscribe(
+	locker *entities.Locker,
+	broker *pubsub.Broker,
+	sess *session,
+) error {
+	entity, err := locker.GetByID(sess.tunnel.EntityID)
+	if err != nil {
+		return err
+	}
 
-	for {
-		select {
-		case notification := <-queue:
-			handleNotification(notification, subscribers)
-		case sub := <-subscriberQueue:
-			for _, noticeType := range sub.NotifyOn() {
-				if _, ok := subscribers[noticeType]; !ok {
-					subscribers[noticeType] = make([]pubsub.Subscriber, 0)
+	pos, ok := entity.Position()
+	if !ok {
+		return errs.Errorf("entity %s has no position", entity.ID)
+	}
+
+	follower := pubsub.MakeFollower(
+		func(notification pubsub.Notification) bool {
+			for _, action := range notification.Actions {
+				message, err := actionMessage(sess.tunnel, action)
+				if err != nil {
+					fmt.Println("could not send action", err)
+					continue
+				}
+
+				if !sess.deliver(message) {
+					return false
 				}
-				subscribers[noticeType] = append(subscribers[noticeType], sub)
 			}
-		default:
-			// no-op
+			return true
+		},
+		entity.ID,
+		pos,
+		interestRadius)
+
+	sess.handles = append(sess.handles, broker.Subscribe(follower))
+	return nil
+}
+
+func handleNotifications(queue chan []pubsub.Notification, broker *pubsub.Broker) {
+	for notifications := range queue {
+		for _, notification := range notifications {
+			broker.Publish(notification)
 		}
 	}
 }
 
-func handleNotification(
-	notification pubsub.Notification,
-	subscribers map[interface{}][]pubsub.Subscriber,
-) {
-	var currentSubs []pubsub.Subscriber
-	var ok bool
+// actionFailures counts the commands rolled back because one of their
+// actions failed to execute.
+var actionFailures uint64
+
+// ActionFailures returns the number of commands rolled back because one of
+// their actions failed to execute.
+func ActionFailures() uint64 {
+	return atomic.LoadUint64(&actionFailures)
+}
+
+// maxQueuedCommands bounds how many commands a single entity may have
+// waiting for future ticks; further commands are rejected.
+const maxQueuedCommands = 32
+
+// commandQueues holds the commands waiting to be applied, per source entity,
+// in the order the entities first queued them.
+type commandQueues struct {
+	byEntity map[uuid.UUID][]request
+	order    []uuid.UUID
+}
 
-	currentSubs, ok = subscribers[notification.Type]
+func makeCommandQueues() commandQueues {
+	return commandQueues{
+		byEntity: make(map[uuid.UUID][]request),
+		order:    make([]uuid.UUID, 0),
+	}
+}
+
+func (queues *commandQueues) Len() int {
+	return len(queues.order)
+}
 
+// Push queues the request for its command's source entity, returning false
+// if that entity already has too many commands waiting.
+func (queues *commandQueues) Push(req request) bool {
+	id := req.command.Source()
+
+	queue, ok := queues.byEntity[id]
 	if !ok {
-		return
+		queues.order = append(queues.order, id)
+	}
+
+	if len(queue) >= maxQueuedCommands {
+		return false
 	}
 
-	for i := len(currentSubs) - 1; i >= 0; i-- {
-		sub := currentSubs[i]
-		retain := sub.Notify(notification)
+	queues.byEntity[id] = append(queue, req)
+	return true
+}
 
-		if !retain {
-			currentSubs = append(
-				currentSubs[:i],
-				currentSubs[i+1:]...,
-			)
+// Tick removes and returns the commands to apply this tick: every queued
+// command of each entity, up to but excluding its second movement.
+func (queues *commandQueues) Tick() []request {
+	batch := make([]request, 0)
+	remaining := queues.order[:0]
 
-			if len(currentSubs) == 0 {
-				delete(subscribers, notification.Type)
+	for _, id := range queues.order {
+		queue := queues.byEntity[id]
+		moved := false
+
+		for len(queue) > 0 {
+			if _, ok := queue[0].command.(commands.Movement); ok {
+				if moved {
+					break
+				}
+				moved = true
 			}
+
+			batch = append(batch, queue[0])
+			queue = queue[1:]
+		}
+
+		if len(queue) == 0 {
+			delete(queues.byEntity, id)
+		} else {
+			queues.byEntity[id] = queue
+			remaining = append(remaining, id)
 		}
 	}
+
+	queues.order = remaining
+	return batch
 }
 
+// handleCommands applies queued commands once per tick, publishing all of
+// the tick's notifications together. Once queue is closed, the remaining
+// commands are applied without waiting between ticks.
 func handleCommands(
 	locker *entities.Locker,
-	queue chan commands.Command,
-	notificationQueue chan pubsub.Notification,
+	memory *commands.Memory,
+	tickRate int,
+	queue chan request,
+	notificationQueue chan []pubsub.Notification,
 ) {
-	for command := range queue {
-		serverMutations, notifications := handleCommand(locker, command)
-		for _, mutation := range serverMutations {
-			mutation.Execute(locker)
+	ticker := time.NewTicker(time.Second / time.Duration(tickRate))
+	defer ticker.Stop()
+
+	pending := makeCommandQueues()
+
+	for {
+		select {
+		case req, ok := <-queue:
+			if !ok {
+				for pending.Len() > 0 {
+					handleTick(locker, memory, pending.Tick(), notificationQueue)
+				}
+				return
+			}
+
+			if !pending.Push(req) {
+				req.reject(commands.Reject(req.command, commands.ReasonThrottled, "too many queued commands"))
+			}
+		case <-ticker.C:
+			handleTick(locker, memory, pending.Tick(), notificationQueue)
 		}
+	}
+}
 
-		for _, notification := range notifications {
-			notificationQueue <- notification
+func handleTick(
+	locker *entities.Locker,
+	memory *commands.Memory,
+	batch []request,
+	notificationQueue chan []pubsub.Notification,
+) {
+	tickNotifications := make([]pubsub.Notification, 0)
+
+	for _, req := range batch {
+		command := req.command
+
+		serverMutations, notifications, rejection := handleCommand(locker, memory, command)
+		if rejection != nil {
+			req.reject(rejection)
+			continue
+		}
+
+		err := locker.Transaction(func(tx *entities.Tx) error {
+			for _, mutation := range serverMutations {
+				if err := mutation.Execute(tx); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			failures := atomic.AddUint64(&actionFailures, 1)
+			fmt.Printf("rolled back %T (%d action failures): %+v\n", command, failures, err)
+
+			req.reject(commands.Reject(command, commands.ReasonFailed, "%v", err))
+			continue
 		}
+
+		tickNotifications = append(tickNotifications, notifications...)
+	}
+
+	if len(tickNotifications) > 0 {
+		notificationQueue <- tickNotifications
 	}
 }
 
-func handleCommand(locker *entities.Locker, command commands.Command) ([]actions.Action, []pubsub.Notification) {
+// handleCommand computes command against the locker. Perceive commands are
+// given the server's memory of each client's view, so that only changes are
+// sent.
+func handleCommand(
+	locker *entities.Locker,
+	memory *commands.Memory,
+	command commands.Command,
+) ([]actions.Action, []pubsub.Notification, *commands.Rejection) {
+	if perceive, ok := command.(commands.Perceive); ok {
+		perceive.Memory = memory
+		command = perceive
+	}
+
 	return command.Compute(locker)
 }
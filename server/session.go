@@ -0,0 +1,240 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/clagraff/devoid/actions"
+	"github.com/clagraff/devoid/commands"
+	"github.com/clagraff/devoid/network"
+	"github.com/clagraff/devoid/pubsub"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// maxQueuedBytes bounds the encoded size of the messages a session may
+// have waiting for its tunnel. A client which falls this far behind is
+// disconnected.
+const maxQueuedBytes = 4 << 20
+
+// session is the server's side of a connected tunnel. Messages for the
+// tunnel are queued without blocking and fed to its outgoing channel by the
+// session's pump, so that bursts larger than that channel's buffer, such as
+// a full Perceive, are not mistaken for a slow client.
+type session struct {
+	tunnel network.Tunnel
+
+	// handles are the subscriptions made on behalf of the tunnel. They are
+	// only accessed by handleTunnels.
+	handles []pubsub.Handle
+
+	mux         *sync.Mutex
+	queue       []network.Message
+	queuedBytes int
+	closed      bool
+	slow        bool
+
+	// wake is signalled whenever the queue grows or the session closes.
+	wake chan struct{}
+
+	// dropped is closed once the session exceeds maxQueuedBytes.
+	dropped chan struct{}
+	done    chan struct{}
+}
+
+func newSession(tunnel network.Tunnel) *session {
+	s := &session{
+		tunnel:  tunnel,
+		handles: make([]pubsub.Handle, 0),
+		mux:     new(sync.Mutex),
+		queue:   make([]network.Message, 0),
+		wake:    make(chan struct{}, 1),
+		dropped: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go s.pump()
+
+	return s
+}
+
+// deliver queues message for the tunnel without blocking, returning false
+// if the session is closed or has too many bytes waiting to be sent. A
+// session over its limit has its queue replaced by a Disconnect, and is
+// reported by its reader for cleanup.
+func (s *session) deliver(message network.Message) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.closed || s.slow {
+		return false
+	}
+
+	if s.queuedBytes+len(message.Content) > maxQueuedBytes {
+		fmt.Println("dropping slow tunnel", s.tunnel.ID)
+
+		s.slow = true
+		s.queue = s.queue[:0]
+		s.queuedBytes = 0
+
+		disconnect := actions.Disconnect{Reason: "could not keep up with notifications"}
+		if message, err := actionMessage(s.tunnel, disconnect); err == nil {
+			s.queue = append(s.queue, message)
+		}
+
+		close(s.dropped)
+		s.signal()
+		return false
+	}
+
+	s.queue = append(s.queue, message)
+	s.queuedBytes += len(message.Content)
+	s.signal()
+	return true
+}
+
+// deliverAction wraps action in a message for the tunnel and delivers it.
+func (s *session) deliverAction(action actions.Action) bool {
+	message, err := actionMessage(s.tunnel, action)
+	if err != nil {
+		fmt.Println("could not send action", err)
+		return false
+	}
+
+	return s.deliver(message)
+}
+
+// signal wakes the pump without blocking. The lock must be held.
+func (s *session) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pump moves queued messages to the tunnel's outgoing channel, blocking
+// while it is full. Once the session is closed and its queue is empty, it
+// closes the outgoing channel, which flushes it and then closes the
+// connection.
+func (s *session) pump() {
+	defer close(s.tunnel.Outgoing)
+
+	for {
+		s.mux.Lock()
+		if len(s.queue) == 0 {
+			closed := s.closed
+			s.mux.Unlock()
+
+			if closed {
+				return
+			}
+
+			<-s.wake
+			continue
+		}
+
+		message := s.queue[0]
+		s.queue[0] = network.Message{}
+		s.queue = s.queue[1:]
+		s.queuedBytes -= len(message.Content)
+		s.mux.Unlock()
+
+		s.tunnel.Outgoing <- message
+	}
+}
+
+// close stops the session's reader, and has the pump close the tunnel once
+// the messages already queued are sent. Later deliveries are dropped.
+func (s *session) close() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+		s.signal()
+	}
+}
+
+// request is a command waiting to be computed, tagged with the session it
+// was received on so that its rejection can be sent straight back.
+type request struct {
+	command commands.Command
+	sess    *session
+}
+
+// reject sends the rejection to the session the request was received on.
+func (req request) reject(rejection *commands.Rejection) {
+	req.sess.deliverAction(rejection.Action())
+}
+
+// read decodes the tunnel's incoming messages into requests, replying
+// directly to malformed messages and to commands the client may not issue,
+// until ctx is cancelled or the session is closed. If the tunnel's
+// connection ends or the session is dropped for being too slow, the session
+// is sent to closed.
+func (s *session) read(
+	ctx context.Context,
+	auth Authorizer,
+	requests chan request,
+	closed chan *session,
+) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.done:
+			return
+		case <-s.tunnel.Closed:
+			s.report(ctx, closed)
+			return
+		case <-s.dropped:
+			s.report(ctx, closed)
+			return
+		case message := <-s.tunnel.Incoming:
+			command, err := commands.Decode(message.ContentType, message.Decode)
+			if err != nil {
+				fmt.Println("could not unmarshal incoming command", err)
+				s.deliverAction(actions.CommandRejected{
+					Reason:   string(commands.ReasonMalformed),
+					Command:  message.ContentType,
+					SourceID: s.tunnel.EntityID,
+					Message:  err.Error(),
+				})
+				continue
+			}
+
+			req := request{command: command, sess: s}
+
+			source := command.Source()
+			if !uuid.Equal(source, s.tunnel.EntityID) && !auth.CanControl(s.tunnel.ID, source) {
+				req.reject(commands.Reject(
+					command,
+					commands.ReasonForbidden,
+					"client %s may not control entity %s",
+					s.tunnel.ID,
+					source,
+				))
+				continue
+			}
+
+			select {
+			case requests <- req:
+			case <-ctx.Done():
+				return
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
+
+// report sends the session to closed, unless ctx is cancelled or the
+// session is closed first.
+func (s *session) report(ctx context.Context, closed chan *session) {
+	select {
+	case closed <- s:
+	case <-ctx.Done():
+	case <-s.done:
+	}
+}
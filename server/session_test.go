@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/clagraff/devoid/actions"
+	"github.com/clagraff/devoid/commands"
+	"github.com/clagraff/devoid/components"
+	"github.com/clagraff/devoid/entities"
+	"github.com/clagraff/devoid/network"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// denyAll is an Authorizer which only lets clients control their own
+// entity.
+type denyAll struct{}
+
+func (denyAll) CanControl(uuid.UUID, uuid.UUID) bool {
+	return false
+}
+
+// makeTunnel returns an in-memory tunnel bound to the entity, with the
+// same buffering as tunnels made by the network package.
+func makeTunnel(entityID uuid.UUID) network.Tunnel {
+	return network.Tunnel{
+		ID:       uuid.Must(uuid.NewV4()),
+		EntityID: entityID,
+		Codec:    network.JSON,
+		Latency:  new(network.Latency),
+		Incoming: make(chan network.Message, 100),
+		Outgoing: make(chan network.Message, 100),
+		Closed:   make(chan struct{}, 1),
+	}
+}
+
+// receive returns the next message sent on the tunnel, failing the test if
+// none arrives within timeout.
+func receive(t *testing.T, tunnel network.Tunnel, timeout time.Duration) network.Message {
+	t.Helper()
+
+	select {
+	case message, ok := <-tunnel.Outgoing:
+		if !ok {
+			t.Fatalf("tunnel %s was closed", tunnel.ID)
+		}
+		return message
+	case <-time.After(timeout):
+		t.Fatalf("no message on tunnel %s after %s", tunnel.ID, timeout)
+	}
+
+	return network.Message{}
+}
+
+func TestPerceiveLargerThanOutgoingBuffer(t *testing.T) {
+	locker := entities.MakeLocker()
+
+	player := uuid.Must(uuid.NewV4())
+	center := components.Position{X: 8, Y: 8}
+	locker.Set(entities.Entity{
+		ID: player,
+		Components: components.MakeSet(
+			center,
+			components.Spatial{Stackable: true},
+			components.Vision{Radius: 8},
+		),
+	})
+
+	for x := 0; x <= 16; x++ {
+		for y := 0; y <= 16; y++ {
+			locker.Set(entities.Entity{
+				ID: uuid.Must(uuid.NewV4()),
+				Components: components.MakeSet(
+					components.Position{X: x, Y: y},
+					components.Spatial{Stackable: true},
+				),
+			})
+		}
+	}
+
+	_, notifications, rejection := commands.Perceive{
+		SourceID: player,
+		Memory:   commands.NewMemory(),
+	}.Compute(&locker)
+	if rejection != nil {
+		t.Fatal(rejection)
+	}
+	full := notifications[0].Actions
+
+	tunnel := makeTunnel(player)
+	if len(full) <= cap(tunnel.Outgoing) {
+		t.Fatalf("only %d entities are visible, which fits in the outgoing buffer", len(full))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tunnels := make(chan network.Tunnel, 1)
+	served := make(chan struct{})
+	go func() {
+		Serve(ctx, Config{TickRate: 50}, &locker, denyAll{}, tunnels)
+		close(served)
+	}()
+
+	tunnels <- tunnel
+
+	// Let the Perceive be computed and queued before anything is read.
+	time.Sleep(200 * time.Millisecond)
+
+	for i := 0; i < len(full); i++ {
+		message := receive(t, tunnel, time.Second)
+		if message.ContentType != "set-entity" {
+			t.Fatalf("message %d is a %s, not a set-entity", i, message.ContentType)
+		}
+	}
+
+	cancel()
+	<-served
+
+	var last network.Message
+	for message := range tunnel.Outgoing {
+		last = message
+	}
+
+	if last.ContentType != "disconnect" {
+		t.Errorf("expected a disconnect at shutdown, got %s", last)
+	}
+}
+
+func TestSlowSessionIsReported(t *testing.T) {
+	tunnel := makeTunnel(uuid.Must(uuid.NewV4()))
+	tunnel.Outgoing = make(chan network.Message)
+
+	sess := newSession(tunnel)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	closed := make(chan *session, 1)
+	go sess.read(ctx, denyAll{}, make(chan request), closed)
+
+	content := make(network.RawContent, 64<<10)
+	delivered := 0
+	for sess.deliver(network.Message{ContentType: "set-entity", Content: content}) {
+		delivered++
+		if delivered > maxQueuedBytes/len(content)+1 {
+			t.Fatalf("delivered %d bytes without being dropped", delivered*len(content))
+		}
+	}
+
+	select {
+	case reported := <-closed:
+		if reported != sess {
+			t.Fatal("a different session was reported")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the slow session was not reported")
+	}
+
+	if sess.deliverAction(actions.ClearAllEntities{}) {
+		t.Error("a dropped session accepted another message")
+	}
+
+	sess.close()
+
+	// The pump may already be blocked sending the first queued message.
+	messages := make([]network.Message, 0)
+	for message := range tunnel.Outgoing {
+		messages = append(messages, message)
+	}
+
+	if len(messages) == 0 || messages[len(messages)-1].ContentType != "disconnect" {
+		t.Errorf("expected the dropped session to end with a disconnect, got %v", messages)
+	}
+}
+
+func TestServeDisconnectsUnspawnableTunnel(t *testing.T) {
+	// A world without spawn points has nowhere to put a new entity.
+	locker := entities.MakeLocker()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tunnels := make(chan network.Tunnel, 1)
+	go Serve(ctx, Config{}, &locker, denyAll{}, tunnels)
+
+	tunnel := makeTunnel(uuid.Must(uuid.NewV4()))
+	tunnels <- tunnel
+
+	message := receive(t, tunnel, time.Second)
+	if message.ContentType != "disconnect" {
+		t.Fatalf("expected a disconnect, got %s", message)
+	}
+
+	select {
+	case _, ok := <-tunnel.Outgoing:
+		if ok {
+			t.Error("expected the tunnel to be closed after the disconnect")
+		}
+	case <-time.After(time.Second):
+		t.Error("the tunnel was left open")
+	}
+}
@@ -0,0 +1,365 @@
+// Package wire implements a compact binary encoding of plain Go values.
+//
+// Values are encoded positionally, without field names or type
+// information, so both ends must agree on the types being exchanged:
+// integers are varints, strings, slices and maps are length-prefixed, and
+// structs are their exported fields in declaration order. Fields tagged
+// `json:"-"` are skipped. Types implementing encoding.BinaryMarshaler and
+// encoding.BinaryUnmarshaler encode themselves; interface values are only
+// supported through them.
+package wire
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+)
+
+var (
+	marshalerType   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	unmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+)
+
+// Marshal returns the wire encoding of v.
+func Marshal(v interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := encode(buf, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes data into the value ptr points to. It is an error for
+// data to hold more than a single value.
+func Unmarshal(data []byte, ptr interface{}) error {
+	value := reflect.ValueOf(ptr)
+	if value.Kind() != reflect.Ptr || value.IsNil() {
+		return fmt.Errorf("wire: cannot unmarshal into non-pointer %T", ptr)
+	}
+
+	r := bytes.NewReader(data)
+	if err := decode(r, value.Elem()); err != nil {
+		return err
+	}
+
+	if r.Len() != 0 {
+		return fmt.Errorf("wire: %d unexpected trailing bytes", r.Len())
+	}
+
+	return nil
+}
+
+func encode(buf *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		return fmt.Errorf("wire: cannot marshal nil value")
+	}
+
+	if v.Kind() != reflect.Ptr && v.Type().Implements(marshalerType) {
+		data, err := v.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		putBytes(buf, data)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		putVarint(buf, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		putUvarint(buf, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		var bits [8]byte
+		binary.BigEndian.PutUint64(bits[:], math.Float64bits(v.Float()))
+		buf.Write(bits[:])
+	case reflect.String:
+		putBytes(buf, []byte(v.String()))
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := encode(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			putBytes(buf, v.Bytes())
+			break
+		}
+
+		putUvarint(buf, uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			if err := encode(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		putUvarint(buf, uint64(v.Len()))
+		for _, key := range v.MapKeys() {
+			if err := encode(buf, key); err != nil {
+				return err
+			}
+			if err := encode(buf, v.MapIndex(key)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if skipField(v.Type().Field(i)) {
+				continue
+			}
+			if err := encode(buf, v.Field(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr:
+		if v.IsNil() {
+			buf.WriteByte(0)
+			break
+		}
+
+		buf.WriteByte(1)
+		return encode(buf, v.Elem())
+	default:
+		return fmt.Errorf("wire: cannot marshal %s", v.Type())
+	}
+
+	return nil
+}
+
+func decode(r *bytes.Reader, v reflect.Value) error {
+	if v.CanAddr() && v.Addr().Type().Implements(unmarshalerType) {
+		data, err := getBytes(r)
+		if err != nil {
+			return err
+		}
+
+		return v.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(data)
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := r.ReadByte()
+		if err != nil {
+			return truncated(err)
+		}
+		v.SetBool(b != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := binary.ReadVarint(r)
+		if err != nil {
+			return truncated(err)
+		}
+		if v.OverflowInt(n) {
+			return fmt.Errorf("wire: %d overflows %s", n, v.Type())
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return truncated(err)
+		}
+		if v.OverflowUint(n) {
+			return fmt.Errorf("wire: %d overflows %s", n, v.Type())
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		var bits [8]byte
+		if _, err := io.ReadFull(r, bits[:]); err != nil {
+			return truncated(err)
+		}
+		f := math.Float64frombits(binary.BigEndian.Uint64(bits[:]))
+		if v.OverflowFloat(f) {
+			return fmt.Errorf("wire: %g overflows %s", f, v.Type())
+		}
+		v.SetFloat(f)
+	case reflect.String:
+		data, err := getBytes(r)
+		if err != nil {
+			return err
+		}
+		v.SetString(string(data))
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := decode(r, v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			data, err := getBytes(r)
+			if err != nil {
+				return err
+			}
+			v.SetBytes(data)
+			break
+		}
+
+		n, err := getCount(r, minSize(v.Type().Elem()))
+		if err != nil {
+			return err
+		}
+
+		slice := reflect.MakeSlice(v.Type(), n, n)
+		for i := 0; i < n; i++ {
+			if err := decode(r, slice.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+	case reflect.Map:
+		n, err := getCount(r, minSize(v.Type().Key())+minSize(v.Type().Elem()))
+		if err != nil {
+			return err
+		}
+
+		m := reflect.MakeMapWithSize(v.Type(), n)
+		for i := 0; i < n; i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := decode(r, key); err != nil {
+				return err
+			}
+
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := decode(r, elem); err != nil {
+				return err
+			}
+
+			m.SetMapIndex(key, elem)
+		}
+		v.Set(m)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if skipField(v.Type().Field(i)) {
+				continue
+			}
+			if err := decode(r, v.Field(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr:
+		present, err := r.ReadByte()
+		if err != nil {
+			return truncated(err)
+		}
+
+		if present == 0 {
+			v.Set(reflect.Zero(v.Type()))
+			break
+		}
+
+		elem := reflect.New(v.Type().Elem())
+		if err := decode(r, elem.Elem()); err != nil {
+			return err
+		}
+		v.Set(elem)
+	default:
+		return fmt.Errorf("wire: cannot unmarshal %s", v.Type())
+	}
+
+	return nil
+}
+
+// skipField reports whether a struct field is left out of the encoding.
+func skipField(field reflect.StructField) bool {
+	return field.PkgPath != "" || field.Tag.Get("json") == "-"
+}
+
+func putUvarint(buf *bytes.Buffer, n uint64) {
+	var scratch [binary.MaxVarintLen64]byte
+	buf.Write(scratch[:binary.PutUvarint(scratch[:], n)])
+}
+
+func putVarint(buf *bytes.Buffer, n int64) {
+	var scratch [binary.MaxVarintLen64]byte
+	buf.Write(scratch[:binary.PutVarint(scratch[:], n)])
+}
+
+func putBytes(buf *bytes.Buffer, data []byte) {
+	putUvarint(buf, uint64(len(data)))
+	buf.Write(data)
+}
+
+// maxEmptyElements bounds the element count of slices and maps whose
+// elements encode to no bytes at all, and so cannot be bounded by the
+// remaining input.
+const maxEmptyElements = 1 << 16
+
+// getCount reads the element count of a slice or map whose elements each
+// encode to at least size bytes, rejecting counts which the remaining input
+// could not hold so corrupt data cannot cause huge allocations.
+func getCount(r *bytes.Reader, size int) (int, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, truncated(err)
+	}
+
+	if size == 0 {
+		if n > maxEmptyElements {
+			return 0, fmt.Errorf("wire: count %d exceeds %d empty elements", n, maxEmptyElements)
+		}
+		return int(n), nil
+	}
+
+	if n > uint64(r.Len()/size) {
+		return 0, fmt.Errorf("wire: count %d exceeds remaining %d bytes", n, r.Len())
+	}
+
+	return int(n), nil
+}
+
+// minSize returns the fewest bytes a value of type t can encode to.
+func minSize(t reflect.Type) int {
+	if t.Kind() != reflect.Ptr &&
+		(t.Implements(marshalerType) || reflect.PtrTo(t).Implements(unmarshalerType)) {
+		return 1
+	}
+
+	switch t.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return 8
+	case reflect.Array:
+		return t.Len() * minSize(t.Elem())
+	case reflect.Struct:
+		size := 0
+		for i := 0; i < t.NumField(); i++ {
+			if !skipField(t.Field(i)) {
+				size += minSize(t.Field(i).Type)
+			}
+		}
+		return size
+	default:
+		return 1
+	}
+}
+
+func getBytes(r *bytes.Reader) ([]byte, error) {
+	n, err := getCount(r, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, truncated(err)
+	}
+
+	return data, nil
+}
+
+func truncated(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("wire: %v", err)
+}
@@ -0,0 +1,182 @@
+package wire_test
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/clagraff/devoid/components"
+	"github.com/clagraff/devoid/wire"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+type inner struct {
+	Name  string
+	Score float32
+}
+
+type outer struct {
+	ID      uuid.UUID
+	Count   int
+	Small   int8
+	Flags   []bool
+	Inner   inner
+	Next    *inner
+	Missing *inner
+	Tags    map[string]uint16
+	Raw     []byte
+	Grid    [2][3]int
+
+	hidden  int
+	Ignored string `json:"-"`
+}
+
+// roundTrip marshals v, and unmarshals it into a new value of the same
+// type.
+func roundTrip(t *testing.T, v interface{}) interface{} {
+	t.Helper()
+
+	data, err := wire.Marshal(v)
+	if err != nil {
+		t.Fatalf("could not marshal %#v: %v", v, err)
+	}
+
+	ptr := reflect.New(reflect.TypeOf(v))
+	if err := wire.Unmarshal(data, ptr.Interface()); err != nil {
+		t.Fatalf("could not unmarshal %#v from %x: %v", v, data, err)
+	}
+
+	return ptr.Elem().Interface()
+}
+
+func TestRoundTrip(t *testing.T) {
+	values := []interface{}{
+		true,
+		false,
+		0,
+		-1,
+		math.MaxInt64,
+		math.MinInt64,
+		int8(math.MinInt8),
+		int16(math.MaxInt16),
+		uint8(math.MaxUint8),
+		uint32(math.MaxUint32),
+		uint64(math.MaxUint64),
+		float32(-1.5),
+		math.Pi,
+		math.Inf(-1),
+		"",
+		"hello, world",
+		[]byte{0, 1, 2, 255},
+		[]string{"a", "", "c"},
+		[]int{-1, 0, 1},
+		[3]uint8{1, 2, 3},
+		map[string]int{"a": 1, "b": -2},
+		map[int][]string{1: {"x"}, 2: {}},
+		[]struct{}{{}, {}},
+		map[string]struct{}{"a": {}, "b": {}},
+		[][0]int{{}, {}, {}},
+		uuid.Must(uuid.NewV4()),
+		inner{Name: "inner", Score: 2.25},
+		outer{
+			ID:    uuid.Must(uuid.NewV4()),
+			Count: 1 << 40,
+			Small: -7,
+			Flags: []bool{true, false, true},
+			Inner: inner{Name: "a"},
+			Next:  &inner{Name: "b", Score: -1},
+			Tags:  map[string]uint16{"port": 8080},
+			Raw:   []byte("raw"),
+			Grid:  [2][3]int{{1, 2, 3}, {-4, -5, -6}},
+		},
+	}
+
+	for _, v := range values {
+		if decoded := roundTrip(t, v); !reflect.DeepEqual(decoded, v) {
+			t.Errorf("%T: expected %#v, got %#v", v, v, decoded)
+		}
+	}
+}
+
+func TestSkippedFields(t *testing.T) {
+	v := outer{hidden: 5, Ignored: "ignored", Flags: []bool{}, Tags: map[string]uint16{}, Raw: []byte{}}
+
+	decoded := roundTrip(t, v).(outer)
+	if decoded.hidden != 0 || decoded.Ignored != "" {
+		t.Errorf("skipped fields were encoded: %#v", decoded)
+	}
+}
+
+func TestBinaryMarshaler(t *testing.T) {
+	set := components.MakeSet(
+		components.Position{X: -3, Y: 4},
+		components.Spatial{Stackable: true},
+		components.Vision{Radius: 8},
+	)
+
+	decoded := roundTrip(t, set).(components.Set)
+
+	var pos components.Position
+	var vision components.Vision
+	if !decoded.Get(&pos) || !decoded.Get(&vision) || decoded.Len() != 3 {
+		t.Fatalf("components were lost: %v", decoded)
+	}
+
+	if pos != (components.Position{X: -3, Y: 4}) || vision.Radius != 8 {
+		t.Errorf("components were changed: %v", decoded)
+	}
+}
+
+func TestUnmarshalOverflow(t *testing.T) {
+	cases := []struct {
+		v   interface{}
+		ptr interface{}
+	}{
+		{1000, new(int8)},
+		{-129, new(int8)},
+		{math.MaxInt32 + 1, new(int32)},
+		{uint(300), new(uint8)},
+		{uint64(math.MaxUint32 + 1), new(uint32)},
+		{1e300, new(float32)},
+	}
+
+	for _, c := range cases {
+		data, err := wire.Marshal(c.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = wire.Unmarshal(data, c.ptr)
+		if err == nil || !strings.Contains(err.Error(), "overflows") {
+			t.Errorf("%v into %T: expected an overflow error, got %v (%v)", c.v, c.ptr, err, reflect.ValueOf(c.ptr).Elem())
+		}
+	}
+}
+
+func TestUnmarshalCorrupt(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+		ptr  interface{}
+	}{
+		{"truncated int", []byte{0x80}, new(int)},
+		{"truncated float", []byte{1, 2, 3}, new(float64)},
+		{"trailing bytes", []byte{2, 0}, new(int)},
+		{"long string", []byte{10, 'a'}, new(string)},
+		{"long bytes", []byte{0xff, 0xff, 0x03}, new([]byte)},
+		{"huge slice", []byte{0xff, 0xff, 0xff, 0xff, 0x0f}, new([]int)},
+		{"slice of floats", []byte{2, 0, 0, 0, 0, 0, 0, 0, 0}, new([]float64)},
+		{"huge map", []byte{0xff, 0xff, 0x03, 1, 1}, new(map[int]int)},
+		{"huge empty slice", []byte{0xff, 0xff, 0xff, 0xff, 0x0f}, new([]struct{})},
+		{"missing pointer", []byte{1}, new(*int)},
+		{"into non-pointer", []byte{0}, 0},
+	}
+
+	for _, c := range cases {
+		if err := wire.Unmarshal(c.data, c.ptr); err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+	}
+}